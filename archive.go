@@ -0,0 +1,149 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// extractArchives unpacks the .epub entries of the zip, tar and tar.gz
+// bundles given to --from-archive into temporary files, one job per entry.
+// zip.OpenReader needs a file it can seek in, which a tar stream isn't, so
+// every entry is copied out regardless of the bundle's format.
+func extractArchives(archives []string) ([]job, error) {
+	var jobs []job
+	for _, archive := range archives {
+		extracted, err := extractArchive(archive)
+		if err != nil {
+			removeExtracted(jobs)
+			return nil, errors.New(archive + ": " + err.Error())
+		}
+
+		jobs = append(jobs, extracted...)
+	}
+
+	return jobs, nil
+}
+
+func extractArchive(archive string) ([]job, error) {
+	lower := strings.ToLower(archive)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return extractZip(archive)
+	case strings.HasSuffix(lower, ".tar"):
+		return extractTar(archive, false)
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return extractTar(archive, true)
+	}
+
+	return nil, errors.New("not a .zip, .tar, .tar.gz or .tgz archive")
+}
+
+func extractZip(archive string) ([]job, error) {
+	f, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var jobs []job
+	for _, file := range f.File {
+		if file.FileInfo().IsDir() || !isEpubName(file.Name) {
+			continue
+		}
+
+		rc, err := openEntry(file)
+		if err != nil {
+			removeExtracted(jobs)
+			return nil, err
+		}
+		j, err := extractEntry(archive, file.Name, rc)
+		rc.Close()
+		if err != nil {
+			removeExtracted(jobs)
+			return nil, err
+		}
+
+		jobs = append(jobs, j)
+	}
+
+	return jobs, nil
+}
+
+func extractTar(archive string, gzipped bool) ([]job, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if gzipped {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+
+		r = gz
+	}
+
+	var jobs []job
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return jobs, nil
+		} else if err != nil {
+			removeExtracted(jobs)
+			return nil, err
+		}
+
+		if header.Typeflag != tar.TypeReg || !isEpubName(header.Name) {
+			continue
+		}
+
+		j, err := extractEntry(archive, header.Name, tr)
+		if err != nil {
+			removeExtracted(jobs)
+			return nil, err
+		}
+
+		jobs = append(jobs, j)
+	}
+}
+
+// extractEntry copies the archive entry name to a temporary file. The job is
+// labelled archive:name so results can be traced back to the bundle.
+func extractEntry(archive string, name string, r io.Reader) (job, error) {
+	f, err := os.CreateTemp("", "epub-renamer-*.epub")
+	if err != nil {
+		return job{}, err
+	}
+	defer f.Close()
+
+	if _, err = io.Copy(f, r); err != nil {
+		os.Remove(f.Name())
+		return job{}, errors.New(name + ": " + err.Error())
+	}
+
+	return job{file: archive + ":" + name, path: f.Name()}, nil
+}
+
+func isEpubName(name string) bool {
+	return strings.EqualFold(path.Ext(name), ".epub")
+}
+
+// removeExtracted deletes the temporary files of jobs that won't be run.
+func removeExtracted(jobs []job) {
+	for _, j := range jobs {
+		if j.path != "" {
+			os.Remove(j.path)
+		}
+	}
+}
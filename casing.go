@@ -0,0 +1,111 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// the --case-style values
+const (
+	caseNone  = "none"
+	caseLower = "lower"
+	caseUpper = "upper"
+	caseTitle = "title"
+)
+
+// defaultSmallWords are the words title casing keeps lower case, roughly the
+// articles, conjunctions and short prepositions of the Chicago Manual of
+// Style.
+const defaultSmallWords = "a,an,the,and,but,or,nor,for,so,yet,as,at,by,in,of,off,on,per,to,up,via,vs"
+
+func validCaseStyle(style string) bool {
+	switch style {
+	case caseNone, caseLower, caseUpper, caseTitle:
+		return true
+	}
+
+	return false
+}
+
+// caser applies --case-style to the fields names are built from.
+type caser struct {
+	style string
+	// small is the --small-words list, lower case
+	small map[string]bool
+}
+
+func newCaser(style string, smallWords string) caser {
+	c := caser{style: style, small: map[string]bool{}}
+	for _, word := range strings.Split(smallWords, ",") {
+		if word = strings.TrimSpace(word); word != "" {
+			c.small[strings.ToLower(word)] = true
+		}
+	}
+
+	return c
+}
+
+func (c *caser) apply(value string) string {
+	switch c.style {
+	case caseLower:
+		return strings.ToLower(value)
+	case caseUpper:
+		return strings.ToUpper(value)
+	case caseTitle:
+		return c.title(value)
+	}
+
+	return value
+}
+
+// title capitalizes every word of value except small words, which are only
+// capitalized as the first or last word or right after a colon. The parts
+// of a hyphenated word are treated as words of their own, so "jack-in-the-box"
+// becomes "Jack-in-the-Box". Words with capitals inside, such as "iPhone" or
+// "NASA", are left alone unless the whole value is upper case.
+func (c *caser) title(value string) string {
+	if strings.ToUpper(value) == value {
+		value = strings.ToLower(value)
+	}
+
+	words := strings.Fields(value)
+	for i, word := range words {
+		force := i == 0 || i == len(words)-1 || strings.HasSuffix(words[i-1], ":")
+
+		parts := strings.Split(word, "-")
+		for j, part := range parts {
+			if c.small[strings.ToLower(strings.TrimFunc(part, isEdgePunct))] && !(force && j == 0) {
+				parts[j] = strings.ToLower(part)
+			} else {
+				parts[j] = capitalize(part)
+			}
+		}
+		words[i] = strings.Join(parts, "-")
+	}
+
+	return strings.Join(words, " ")
+}
+
+func isEdgePunct(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+// capitalize upper cases the first letter of word, past any leading
+// punctuation such as quotes or brackets.
+func capitalize(word string) string {
+	for i, r := range word {
+		if unicode.IsLetter(r) {
+			if hasInnerCapital(word[i+utf8.RuneLen(r):]) {
+				return word
+			}
+			return word[:i] + string(unicode.ToTitle(r)) + word[i+utf8.RuneLen(r):]
+		}
+	}
+
+	return word
+}
+
+func hasInnerCapital(s string) bool {
+	return strings.IndexFunc(s, unicode.IsUpper) >= 0
+}
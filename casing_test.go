@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestTitleCase(t *testing.T) {
+	c := newCaser(caseTitle, defaultSmallWords)
+
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"the lord of the rings", "The Lord of the Rings"},
+		{"a tale of two cities", "A Tale of Two Cities"},
+		{"of mice and men", "Of Mice and Men"},
+		{"what the wind is for", "What the Wind Is For"},
+		{"dune: the desert planet", "Dune: The Desert Planet"},
+		{"surely: an essay on the by", "Surely: An Essay on the By"},
+		{"jack-in-the-box", "Jack-in-the-Box"},
+		{"the man in the high-castle", "The Man in the High-Castle"},
+		{"my iPhone and me", "My iPhone and Me"},
+		{"a brief history of NASA", "A Brief History of NASA"},
+		{"THE GREAT GATSBY", "The Great Gatsby"},
+		{"OF MICE AND MEN", "Of Mice and Men"},
+		{`"the" quoted title`, `"The" Quoted Title`},
+		{"  extra   spaces  ", "Extra Spaces"},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		if got := c.apply(test.in); got != test.want {
+			t.Errorf("title(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestTitleCaseSmallWords(t *testing.T) {
+	c := newCaser(caseTitle, " With , FROM")
+
+	if got, want := c.apply("escape from the planet with apes"), "Escape from The Planet with Apes"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	conflictOverwrite = "overwrite"
+	conflictSkip      = "skip"
+	conflictSuffix    = "suffix"
+	// conflictKeepSourceDir disambiguates with the name of the directory the
+	// source came from, warning about the conflict
+	conflictKeepSourceDir = "warn-keep-source-dir"
+	// conflictHash disambiguates with a short hash of the source's
+	// contents, so the name a book ends up with doesn't depend on the order
+	// the books were processed in
+	conflictHash = "hash"
+)
+
+// the fields --collision-suffix can take a suffix from
+const (
+	suffixNumber = "number"
+	suffixYear   = "year"
+	suffixISBN   = "isbn"
+	suffixUID    = "uid"
+)
+
+func validConflictPolicy(policy string) bool {
+	switch policy {
+	case conflictOverwrite, conflictSkip, conflictSuffix, conflictKeepSourceDir, conflictHash:
+		return true
+	}
+
+	return false
+}
+
+func validCollisionSuffix(suffix string) bool {
+	switch suffix {
+	case suffixNumber, suffixYear, suffixISBN, suffixUID:
+		return true
+	}
+
+	return false
+}
+
+// collisionLabel returns the --collision-suffix field of data, or "" when
+// suffixes should just be numbered.
+func collisionLabel(suffix string, data *BookData) string {
+	if data == nil {
+		return ""
+	}
+
+	switch suffix {
+	case suffixYear:
+		return data.Year
+	case suffixISBN:
+		return data.ISBN
+	case suffixUID:
+		return data.UID
+	}
+
+	return ""
+}
+
+type targetResolver struct {
+	policy string
+	// suffix is the --collision-suffix field used by the suffix policy
+	suffix string
+	// foldCase treats names differing only in case as the same file, as
+	// case-insensitive filesystems (macOS, Windows) do
+	foldCase bool
+	// fsFoldsCase is set when the output directory's filesystem folds case
+	// itself, so that a plain lookup already finds a name in another case.
+	// Otherwise foldCase is emulated with an index of the names in each
+	// directory.
+	fsFoldsCase bool
+
+	mu sync.Mutex
+	// claimed maps each output path handed out during this run to its
+	// source, so that two workers can't both pick a name that doesn't exist
+	// on disk yet
+	claimed map[string]string
+
+	namesMu sync.Mutex
+	// names maps a directory to the lower case names in it, listed the
+	// first time a name in it is looked up without fsFoldsCase
+	names map[string]map[string]bool
+}
+
+// resolve applies the conflict policy to target, returning the path that
+// source should be written to, or "" when source should be skipped. The
+// returned path is claimed for source until the end of the run. With the
+// suffix policy, label is tried as a suffix before falling back to numbers;
+// the hash policy tries the hash of source instead, which is only computed
+// once there is a conflict.
+//
+// When reserve is set and the policy doesn't overwrite, a free path is also
+// claimed on disk by creating it with O_EXCL before it is returned. That
+// creation is atomic, so another epub-renamer writing to the same directory
+// can never be handed the same name; whoever loses the race moves on to the
+// next candidate. The caller fills in the empty file it is given.
+func (r *targetResolver) resolve(target string, source string, label string, reserve bool) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if sameFile(target, source) {
+		return "", nil
+	}
+
+	if claimant, ok := r.claimed[r.key(target)]; ok && r.policy == conflictOverwrite {
+		return "", errors.New(source + ": " + target + " is also the output of " + claimant)
+	}
+
+	taken, err := r.taken(target)
+	if err != nil {
+		return "", err
+	}
+	if !taken && reserve && r.policy != conflictOverwrite {
+		if taken, err = r.reserve(target); err != nil {
+			return "", err
+		}
+	}
+	if !taken {
+		return r.claim(target, source), nil
+	}
+
+	switch r.policy {
+	case conflictSkip:
+		return "", nil
+	case conflictHash:
+		// hashing a large book would hold up every other worker, so it
+		// happens unlocked and the target is checked again afterwards
+		r.mu.Unlock()
+		hash, err := fileHash(source)
+		r.mu.Lock()
+		if err != nil {
+			return "", errors.New(source + ": " + err.Error())
+		}
+		if path, done, err := r.try(target, source, reserve); done {
+			return path, err
+		}
+		label = hash
+		fallthrough
+	case conflictSuffix, conflictKeepSourceDir:
+		if r.policy == conflictKeepSourceDir {
+			log.Print(source + ": " + target + " is taken, keeping the source directory in the name")
+		}
+
+		ext := filepath.Ext(target)
+		base := strings.TrimSuffix(target, ext)
+		if label != "" {
+			if path, done, err := r.try(fmt.Sprintf("%s (%s)%s", base, label, ext), source, reserve); done {
+				return path, err
+			}
+		}
+
+		for i := 1; ; i++ {
+			if path, done, err := r.try(fmt.Sprintf("%s (%d)%s", base, i, ext), source, reserve); done {
+				return path, err
+			}
+		}
+	}
+
+	return r.claim(target, source), nil
+}
+
+// try claims candidate for source when it is free. done is false when the
+// caller should move on to the next candidate.
+func (r *targetResolver) try(candidate string, source string, reserve bool) (path string, done bool, err error) {
+	if sameFile(candidate, source) {
+		return "", true, nil
+	}
+
+	taken, err := r.taken(candidate)
+	if err == nil && !taken && reserve {
+		taken, err = r.reserve(candidate)
+	}
+	if err != nil {
+		return "", true, err
+	} else if taken {
+		return "", false, nil
+	}
+
+	return r.claim(candidate, source), true, nil
+}
+
+func (r *targetResolver) key(path string) string {
+	path = filepath.Clean(path)
+	if r.foldCase {
+		return strings.ToLower(path)
+	}
+
+	return path
+}
+
+func (r *targetResolver) claim(path string, source string) string {
+	if r.claimed == nil {
+		r.claimed = map[string]string{}
+	}
+	r.claimed[r.key(path)] = source
+
+	return path
+}
+
+// taken reports whether path was claimed earlier in the run or already
+// exists on disk.
+func (r *targetResolver) taken(path string) (bool, error) {
+	if _, ok := r.claimed[r.key(path)]; ok {
+		return true, nil
+	}
+
+	return r.exists(path)
+}
+
+// reserve creates path exclusively, reporting whether something else
+// created it first.
+func (r *targetResolver) reserve(path string) (taken bool, err error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if errors.Is(err, fs.ErrExist) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return false, f.Close()
+}
+
+func (r *targetResolver) exists(path string) (bool, error) {
+	if !r.foldCase || r.fsFoldsCase {
+		return pathExists(path)
+	}
+
+	names, err := r.dirNames(filepath.Dir(path))
+	if err != nil {
+		return false, err
+	}
+
+	return names[strings.ToLower(filepath.Base(path))], nil
+}
+
+// dirNames returns the lower case names of the entries of dir. The listing
+// is only made once per directory: what this run writes there is claimed,
+// and claims are checked before the listing.
+func (r *targetResolver) dirNames(dir string) (map[string]bool, error) {
+	r.namesMu.Lock()
+	defer r.namesMu.Unlock()
+
+	dir = filepath.Clean(dir)
+	if names, ok := r.names[dir]; ok {
+		return names, nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	// a subdirectory a dry run hasn't created has no names yet
+	names := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		names[strings.ToLower(entry.Name())] = true
+	}
+
+	if r.names == nil {
+		r.names = map[string]map[string]bool{}
+	}
+	r.names[dir] = names
+
+	return names, nil
+}
+
+func pathExists(path string) (bool, error) {
+	_, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// sameFile reports whether a and b refer to the same file, which happens
+// when a file is renamed in place and already has its computed name.
+func sameFile(a string, b string) bool {
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+
+	bInfo, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+
+	return os.SameFile(aInfo, bInfo)
+}
+
+// isCaseInsensitive reports whether dir treats names differing only in case
+// as the same file, by looking up an existing entry under its name with the
+// case swapped. When no entry has a letter in its name, dir is probed by
+// creating a lower case temporary file and looking it up by its upper case
+// name, unless probe is false, when dir is assumed to be case-sensitive.
+func isCaseInsensitive(dir string, probe bool) (bool, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range entries {
+		swapped := swapCase(entry.Name())
+		if swapped == entry.Name() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// removed since it was listed
+			continue
+		}
+
+		other, err := os.Lstat(filepath.Join(dir, swapped))
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		// both names can exist side by side on a case-sensitive filesystem
+		return os.SameFile(info, other), nil
+	}
+	if !probe {
+		return false, nil
+	}
+
+	f, err := os.CreateTemp(dir, ".epub-renamer-case-*")
+	if err != nil {
+		return false, err
+	}
+	name := f.Name()
+	f.Close()
+	defer os.Remove(name)
+
+	exists, err := pathExists(filepath.Join(dir, strings.ToUpper(filepath.Base(name))))
+	if err != nil {
+		return false, err
+	}
+
+	return exists, nil
+}
+
+// swapCase turns the upper case letters of name into lower case ones and
+// the other way around.
+func swapCase(name string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsUpper(r) {
+			return unicode.ToLower(r)
+		}
+		return unicode.ToUpper(r)
+	}, name)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// resolveAll resolves target for n sources at once and returns the paths
+// handed out.
+func resolveAll(r *targetResolver, target string, n int, reserve bool) ([]string, error) {
+	paths := make([]string, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			paths[i], errs[i] = r.resolve(target, fmt.Sprintf("source-%d.epub", i), "", reserve)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return paths, nil
+}
+
+func checkDistinct(t *testing.T, paths []string, existing string) {
+	t.Helper()
+
+	seen := map[string]bool{}
+	for _, path := range paths {
+		if path == "" || path == existing || seen[path] {
+			t.Fatalf("%q handed out twice, empty or already on disk: %q", path, paths)
+		}
+		seen[path] = true
+	}
+}
+
+// Run with -race: the claimed-name registry is what keeps workers from
+// picking the same suffix for names that don't exist on disk yet.
+func TestResolveConcurrentSuffixes(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "Book.epub")
+	if err := os.WriteFile(existing, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	paths, err := resolveAll(&targetResolver{policy: conflictSuffix}, existing, 64, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDistinct(t, paths, existing)
+}
+
+// Two resolvers stand in for two processes writing to the same directory:
+// they share nothing but the filesystem, so only the O_EXCL reservation
+// keeps them from handing out the same name.
+func TestResolveAcrossProcesses(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "Book.epub")
+
+	first := &targetResolver{policy: conflictSuffix}
+	second := &targetResolver{policy: conflictSuffix}
+
+	var wg sync.WaitGroup
+	var firstPaths, secondPaths []string
+	var firstErr, secondErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		firstPaths, firstErr = resolveAll(first, target, 32, true)
+	}()
+	go func() {
+		defer wg.Done()
+		secondPaths, secondErr = resolveAll(second, target, 32, true)
+	}()
+	wg.Wait()
+	if firstErr != nil || secondErr != nil {
+		t.Fatal(firstErr, secondErr)
+	}
+
+	checkDistinct(t, append(firstPaths, secondPaths...), "")
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 64 {
+		t.Errorf("%d names reserved on disk, want 64", len(entries))
+	}
+}
+
+// With foldCase, as on a case-insensitive filesystem, a name differing
+// from one on disk or claimed earlier only in case is a conflict. The test
+// runs on whatever filesystem TempDir is on, so the comparison is simulated
+// by the resolver alone.
+func TestResolveFoldCase(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "Book.epub")
+	if err := os.WriteFile(existing, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &targetResolver{policy: conflictSuffix, foldCase: true}
+	if got, want := r.key(filepath.Join(dir, "sub", "..", "BOOK.epub")), r.key(existing); got != want {
+		t.Errorf("key = %q, want %q", got, want)
+	}
+
+	path, err := r.resolve(filepath.Join(dir, "book.epub"), "first.epub", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "book (1).epub"); path != want {
+		t.Errorf("got %q, want %q", path, want)
+	}
+
+	path, err = r.resolve(filepath.Join(dir, "BOOK (1).epub"), "second.epub", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "BOOK (1) (1).epub"); path != want {
+		t.Errorf("got %q, want %q for a name claimed earlier in another case", path, want)
+	}
+
+	caseSensitive := &targetResolver{policy: conflictSuffix}
+	if caseSensitive.key(existing) == caseSensitive.key(filepath.Join(dir, "book.epub")) {
+		t.Error("without foldCase, names differing in case got the same key")
+	}
+}
+
+// The hash policy hashes sources without holding the resolver's lock, so
+// the claims made meanwhile by other workers must still be respected.
+func TestResolveConcurrentHashes(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "Book.epub")
+	if err := os.WriteFile(target, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 32
+	sources := make([]string, n)
+	for i := range sources {
+		sources[i] = filepath.Join(dir, fmt.Sprintf("source-%d.epub", i))
+		// half the sources share their contents, and so their hash
+		if err := os.WriteFile(sources[i], []byte(strconv.Itoa(i%(n/2))), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := &targetResolver{policy: conflictHash}
+	paths := make([]string, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range sources {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			paths[i], errs[i] = r.resolve(target, sources[i], "", true)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkDistinct(t, paths, target)
+}
+
+// Case sensitivity is read off an existing entry where there is one, and
+// without probe an empty directory is left untouched.
+func TestIsCaseInsensitive(t *testing.T) {
+	empty := t.TempDir()
+	if folds, err := isCaseInsensitive(empty, false); err != nil || folds {
+		t.Errorf("empty directory without probing: got %v (%v), want false", folds, err)
+	}
+	if entries, _ := os.ReadDir(empty); len(entries) != 0 {
+		t.Errorf("%d files left in the directory, want none", len(entries))
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "Book.epub"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	want, err := pathExists(filepath.Join(dir, "bOOK.EPUB"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if folds, err := isCaseInsensitive(dir, false); err != nil || folds != want {
+		t.Errorf("got %v (%v), want %v", folds, err, want)
+	}
+	if probed, err := isCaseInsensitive(empty, true); err != nil || probed != want {
+		t.Errorf("probing: got %v (%v), want %v", probed, err, want)
+	}
+
+	if !want {
+		// a second file whose name only differs in case is no proof of
+		// a case-insensitive filesystem
+		if err := os.WriteFile(filepath.Join(dir, "bOOK.EPUB"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if folds, err := isCaseInsensitive(dir, false); err != nil || folds {
+			t.Errorf("with both names on disk: got %v (%v), want false", folds, err)
+		}
+	}
+}
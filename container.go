@@ -0,0 +1,125 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	containerPath = "META-INF/container.xml"
+	opfMediaType  = "application/oebps-package+xml"
+)
+
+type epubContainer struct {
+	Rootfiles []epubRootfile `xml:"rootfiles>rootfile"`
+}
+
+type epubRootfile struct {
+	FullPath  string `xml:"full-path,attr"`
+	MediaType string `xml:"media-type,attr"`
+}
+
+func findZipFile(r *zip.Reader, name string) *zip.File {
+	for _, file := range r.File {
+		if file.Name == name {
+			return file
+		}
+	}
+
+	return nil
+}
+
+// readContainer parses META-INF/container.xml, which names the OPF (or OPFs,
+// for multiple renditions) of the book.
+func readContainer(r *zip.Reader) (*epubContainer, error) {
+	file := findZipFile(r, containerPath)
+	if file == nil {
+		return nil, errors.New(containerPath + " is missing")
+	}
+
+	rc, err := openEntry(file)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	var container epubContainer
+	if err = xml.NewDecoder(rc).Decode(&container); err != nil {
+		return nil, err
+	}
+	if len(container.Rootfiles) == 0 {
+		return nil, errors.New(containerPath + " lists no rootfile")
+	}
+
+	return &container, nil
+}
+
+// rootfile picks the rendition to read. rendition is a 1-based index into
+// the rootfiles or a media type; when it is empty the first OPF rootfile is
+// used, falling back to the first rootfile of any type.
+func (c *epubContainer) rootfile(rendition string) (int, *epubRootfile, error) {
+	if rendition == "" {
+		for i := range c.Rootfiles {
+			if c.Rootfiles[i].MediaType == opfMediaType {
+				return i, &c.Rootfiles[i], nil
+			}
+		}
+
+		return 0, &c.Rootfiles[0], nil
+	}
+
+	if isDigits(rendition) {
+		i, err := strconv.Atoi(rendition)
+		if err != nil || i < 1 || i > len(c.Rootfiles) {
+			return 0, nil, fmt.Errorf("there is no rendition %s, %s lists %d", rendition, containerPath, len(c.Rootfiles))
+		}
+
+		return i - 1, &c.Rootfiles[i-1], nil
+	}
+
+	for i := range c.Rootfiles {
+		if strings.EqualFold(c.Rootfiles[i].MediaType, rendition) {
+			return i, &c.Rootfiles[i], nil
+		}
+	}
+
+	return 0, nil, errors.New("no rendition has media type " + rendition)
+}
+
+// isStrictEpub is the check of --native-detect: an uncompressed mimetype
+// entry holding the epub media type comes first in the archive, and the
+// container is there.
+func isStrictEpub(r *zip.Reader) bool {
+	return checkMimetypeEntry(r) == nil && findZipFile(r, containerPath) != nil
+}
+
+// hasEpubStructure reports whether a zip that wasn't recognised from its
+// first bytes is an epub anyway. mimetype only looks for the epub media type
+// at the start of the archive, so books written with the mimetype entry out
+// of place, or compressed, are detected as plain zips; reading the entry (or
+// finding the container) from the central directory doesn't depend on where
+// it sits, and costs no more than the zip open that follows.
+func hasEpubStructure(r *zip.Reader) bool {
+	if findZipFile(r, containerPath) != nil {
+		return true
+	}
+
+	file := findZipFile(r, "mimetype")
+	if file == nil {
+		return false
+	}
+
+	rc, err := openEntry(file)
+	if err != nil {
+		return false
+	}
+	defer rc.Close()
+
+	content, err := io.ReadAll(io.LimitReader(rc, int64(len(epubMimetype))+1))
+	return err == nil && strings.TrimSpace(string(content)) == epubMimetype
+}
@@ -0,0 +1,10 @@
+package main
+
+import (
+	"io"
+	"log"
+)
+
+// debugLog is written to by the details only --debug asks for, such as which
+// OPF of a book was read.
+var debugLog = log.New(io.Discard, "debug: ", log.LstdFlags)
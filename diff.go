@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sort"
+)
+
+// outputDiff collects what a --diff dry run would change in the output
+// directory.
+type outputDiff struct {
+	added       []string
+	overwritten []string
+	// seen holds the resolver keys of every planned target and every
+	// input, neither of which is an orphan
+	seen map[string]bool
+}
+
+func newOutputDiff() *outputDiff {
+	return &outputDiff{seen: map[string]bool{}}
+}
+
+func (d *outputDiff) add(result *Result, r *targetResolver) {
+	for _, path := range []string{result.path, result.kept} {
+		if path != "" {
+			d.seen[r.key(path)] = true
+		}
+	}
+	if result.Status != statusPlanned {
+		return
+	}
+
+	d.seen[r.key(result.Target)] = true
+	line := result.Target + " <- " + result.File
+	if result.replaces {
+		d.overwritten = append(d.overwritten, line)
+	} else {
+		d.added = append(d.added, line)
+	}
+}
+
+// print lists the new and overwritten targets and the files in dir whose
+// extension is one of opts.inputExts that no input would produce, the
+// orphans.
+func (d *outputDiff) print(w io.Writer, dir string, opts *options) error {
+	var orphans []string
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() && opts.inputExts.matches(path) && !d.seen[opts.resolver.key(path)] {
+			orphans = append(orphans, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(d.added)
+	sort.Strings(d.overwritten)
+	for _, line := range d.added {
+		fmt.Fprintln(w, "+ "+line)
+	}
+	for _, line := range d.overwritten {
+		fmt.Fprintln(w, "~ "+line)
+	}
+	for _, orphan := range orphans {
+		fmt.Fprintln(w, "- "+orphan)
+	}
+	fmt.Fprintf(w, "%d new, %d overwritten, %d without an input\n", len(d.added), len(d.overwritten), len(orphans))
+
+	return nil
+}
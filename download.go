@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+func isURL(file string) bool {
+	return strings.HasPrefix(file, "http://") || strings.HasPrefix(file, "https://")
+}
+
+// processURL downloads url to a temporary file and processes that, so the
+// metadata and mimetype checks see the downloaded bytes.
+func processURL(ctx context.Context, url string, opts *options) Result {
+	path, err := download(ctx, url, opts)
+	if err != nil {
+		return failed(url, errors.New(url+": "+err.Error()))
+	}
+	defer os.Remove(path)
+
+	return process(ctx, url, path, opts)
+}
+
+func download(ctx context.Context, url string, opts *options) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	client := http.Client{Timeout: opts.downloadTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("download failed: %s", resp.Status)
+	}
+
+	f, err := os.CreateTemp("", "epub-renamer-*.epub")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err = io.Copy(f, resp.Body); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
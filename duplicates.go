@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	duplicateISBN        = "isbn"
+	duplicateTitleAuthor = "title+author"
+	duplicateHash        = "content-hash"
+)
+
+func validDuplicateKey(key string) bool {
+	return key == duplicateISBN || key == duplicateTitleAuthor || key == duplicateHash
+}
+
+// identityKey returns the key --find-duplicates groups the book at path by,
+// or "" when the book has nothing to group it by.
+func identityKey(key string, data *BookData, path string) (string, error) {
+	switch key {
+	case duplicateISBN:
+		return strings.ToUpper(strings.Map(func(r rune) rune {
+			if r >= '0' && r <= '9' || r == 'x' || r == 'X' {
+				return r
+			}
+			return -1
+		}, data.ISBN)), nil
+	case duplicateTitleAuthor:
+		title := identityText(data.Title)
+		if title == "" {
+			return "", nil
+		}
+		return title + " / " + identityText(data.Author), nil
+	}
+
+	return fileDigest(path)
+}
+
+// identityText folds case, normalization and punctuation out of value so
+// that "The Hobbit" and "the hobbit." compare equal.
+func identityText(value string) string {
+	value = strings.ToLower(norm.NFC.String(canonicalPunctuation.Replace(value)))
+	return collapseSpaces(unicodeFieldRun.ReplaceAllString(value, " "))
+}
+
+// findDuplicates prints the groups of files that share an identity key and
+// returns how many files could not be read.
+func findDuplicates(files []string, key string, opts *options) int {
+	type identity struct {
+		file string
+		key  string
+		err  error
+	}
+
+	identities := make([]identity, len(files))
+	forEach(len(files), opts.workers, func(i int) {
+		file := files[i]
+		id := identity{file: file}
+		if key == duplicateHash {
+			// the contents are all there is to compare, so there is no
+			// need to parse the book
+			id.key, id.err = fileDigest(file)
+		} else if data, _, err := readBook(file, file, opts); err != nil {
+			id.err = err
+		} else {
+			id.key, id.err = identityKey(key, &data, file)
+		}
+		identities[i] = id
+	})
+
+	groups := map[string][]string{}
+	failed, unkeyed := 0, 0
+	for _, id := range identities {
+		switch {
+		case id.err != nil:
+			failed++
+			log.Print(id.err.Error())
+		case id.key == "":
+			unkeyed++
+		default:
+			groups[id.key] = append(groups[id.key], id.file)
+		}
+	}
+
+	var keys []string
+	for k, group := range groups {
+		if len(group) > 1 {
+			keys = append(keys, k)
+			sort.Strings(group)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		fmt.Printf("%s (%d files)\n", k, len(groups[k]))
+		for _, file := range groups[k] {
+			fmt.Println("  " + file)
+		}
+	}
+
+	fmt.Println("duplicate groups:", len(keys))
+	if unkeyed > 0 {
+		fmt.Printf("no %s: %d\n", key, unkeyed)
+	}
+	fmt.Println("failed:", failed)
+	return failed
+}
+
+// knownIDs are the identifiers given to --skip-known, normalized by
+// knownID.
+type knownIDs map[string]bool
+
+// readKnownIDs reads one identifier per line from path, taking the first
+// tab or comma separated field so that exported manifests work as they are.
+// Blank lines and lines starting with # are ignored.
+func readKnownIDs(path string) (knownIDs, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	known := knownIDs{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if i := strings.IndexAny(line, "\t,"); i >= 0 {
+			line = line[:i]
+		}
+		if id := knownID(line); id != "" {
+			known[id] = true
+		}
+	}
+
+	return known, scanner.Err()
+}
+
+// knownID normalizes an ISBN or UID so that 978-0-7432-7356-5,
+// urn:isbn:9780743273565 and 9780743273565 are the same.
+func knownID(id string) string {
+	id = strings.TrimSpace(id)
+	if strings.HasPrefix(strings.ToLower(id), "urn:isbn:") {
+		id = id[len("urn:isbn:"):]
+	}
+
+	if isbn := strings.NewReplacer("-", "", " ", "").Replace(id); isDigits(strings.TrimSuffix(strings.ToUpper(isbn), "X")) {
+		return strings.ToUpper(isbn)
+	}
+
+	return strings.ToLower(id)
+}
+
+// match returns the identifier of data found in known, or "".
+func (known knownIDs) match(data *BookData) string {
+	for _, id := range []string{data.ISBN, data.UID} {
+		if id != "" && known[knownID(id)] {
+			return id
+		}
+	}
+
+	return ""
+}
+
+// outputIndex maps the identity keys of the books already in an output
+// directory to their paths, for --replace-existing-only.
+type outputIndex map[string]string
+
+// indexOutput reads every book under dir. Files that can't be read are
+// logged and left out, since nothing can be matched against them.
+func indexOutput(dir string, opts *options) (outputIndex, error) {
+	index := outputIndex{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !opts.inputExts.matches(path) {
+			return nil
+		}
+
+		data, _, err := readBook(path, path, opts)
+		if err != nil {
+			log.Print(err.Error())
+			return nil
+		}
+
+		for _, key := range index.keys(&data) {
+			if _, ok := index[key]; !ok {
+				index[key] = path
+			}
+		}
+		return nil
+	})
+
+	return index, err
+}
+
+// keys are the ISBN and title+author keys of data, whichever it has.
+func (index outputIndex) keys(data *BookData) []string {
+	var keys []string
+	for _, key := range []string{duplicateISBN, duplicateTitleAuthor} {
+		if id, _ := identityKey(key, data, ""); id != "" {
+			keys = append(keys, key+":"+id)
+		}
+	}
+
+	return keys
+}
+
+// match returns the existing copy of the book data describes, or "".
+func (index outputIndex) match(data *BookData) string {
+	for _, key := range index.keys(data) {
+		if path, ok := index[key]; ok {
+			return path
+		}
+	}
+
+	return ""
+}
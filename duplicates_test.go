@@ -0,0 +1,28 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The content-hash key only looks at the bytes, so files that don't parse
+// as books are still compared rather than failed.
+func TestFindDuplicatesByContentHash(t *testing.T) {
+	dir := t.TempDir()
+	var files []string
+	for name, content := range map[string]string{"a.epub": "same", "b.epub": "same", "c.epub": "other"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, path)
+	}
+
+	if failed := findDuplicates(files, duplicateHash, &options{workers: 2}); failed != 0 {
+		t.Errorf("%d files failed, want none", failed)
+	}
+	if failed := findDuplicates(files, duplicateISBN, &options{workers: 2}); failed != len(files) {
+		t.Errorf("%d files failed by ISBN, want all %d", failed, len(files))
+	}
+}
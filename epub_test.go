@@ -0,0 +1,211 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testContainer is a container.xml naming the OPF at opfPath.
+func testContainer(opfPath string) string {
+	return `<?xml version="1.0"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles><rootfile full-path="` + opfPath + `" media-type="application/oebps-package+xml"/></rootfiles>
+</container>`
+}
+
+// testOPF is a minimal OPF 2 package with title, author and any extra
+// metadata elements.
+func testOPF(title string, author string, extra string) string {
+	return `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="2.0" unique-identifier="bookid">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:opf="http://www.idpf.org/2007/opf">
+    <dc:title>` + title + `</dc:title>
+    <dc:creator opf:role="aut">` + author + `</dc:creator>
+    <dc:identifier id="bookid">urn:uuid:0c1a5f3e-7e8d-4b1a-9d3c-2f6e8a9b1c4d</dc:identifier>
+    ` + extra + `
+  </metadata>
+  <manifest><item id="c1" href="c1.xhtml" media-type="application/xhtml+xml"/></manifest>
+  <spine><itemref idref="c1"/></spine>
+</package>`
+}
+
+// zipEntry describes an entry of a test archive.
+type zipEntry struct {
+	name    string
+	content string
+	method  uint16
+}
+
+// buildZip returns an archive of entries in order.
+func buildZip(t testing.TB, entries []zipEntry) []byte {
+	t.Helper()
+
+	var b bytes.Buffer
+	w := zip.NewWriter(&b)
+	for _, entry := range entries {
+		f, err := w.CreateHeader(&zip.FileHeader{Name: entry.name, Method: entry.method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = f.Write([]byte(entry.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return b.Bytes()
+}
+
+// epubEntries are the entries of a well-formed epub with the given OPF at
+// opfPath, followed by extra.
+func epubEntries(opfPath string, opf string, extra ...zipEntry) []zipEntry {
+	entries := []zipEntry{
+		{name: "mimetype", content: epubMimetype, method: zip.Store},
+		{name: containerPath, content: testContainer(opfPath), method: zip.Deflate},
+		{name: opfPath, content: opf, method: zip.Deflate},
+	}
+
+	return append(entries, extra...)
+}
+
+// writeEpub writes the archive of entries to name in dir and returns its
+// path.
+func writeEpub(t testing.TB, dir string, name string, entries []zipEntry) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, buildZip(t, entries), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// openTestZip opens the archive of entries in memory.
+func openTestZip(t testing.TB, entries []zipEntry) *zip.Reader {
+	t.Helper()
+
+	content := buildZip(t, entries)
+	r, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return r
+}
+
+// fixtureEntry returns the testdata file name as the zip entry entryName.
+func fixtureEntry(t testing.TB, name string, entryName string) *zip.File {
+	t.Helper()
+
+	content, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := openTestZip(t, []zipEntry{{name: entryName, content: string(content), method: zip.Deflate}})
+	return r.File[0]
+}
+
+// benchmarkReadBook reads the epub at path with opts until b is done.
+func benchmarkReadBook(b *testing.B, path string, opts *options) {
+	b.Helper()
+
+	for i := 0; i < b.N; i++ {
+		if _, _, err := readBook(path, path, opts); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkDetect compares --native-detect, which only looks at the zip
+// structure, with sniffing the content for the format.
+func BenchmarkDetect(b *testing.B) {
+	chapter := zipEntry{name: "c1.xhtml", content: strings.Repeat("<p>Call me Ishmael.</p>\n", 4096), method: zip.Deflate}
+	path := writeEpub(b, b.TempDir(), "book.epub", epubEntries("content.opf", testOPF("Moby Dick", "Herman Melville", ""), chapter))
+
+	b.Run("native", func(b *testing.B) {
+		benchmarkReadBook(b, path, &options{nativeDetect: true})
+	})
+	b.Run("mimetype", func(b *testing.B) {
+		benchmarkReadBook(b, path, &options{})
+	})
+}
+
+// misplacedMimetypeEntries are epubs that content sniffing only sees as
+// plain zips, because the mimetype entry isn't first and stored.
+func misplacedMimetypeEntries() map[string][]zipEntry {
+	opf := testOPF("Moby Dick", "Herman Melville", "")
+	conforming := epubEntries("content.opf", opf)
+
+	return map[string][]zipEntry{
+		"compressed mimetype": append([]zipEntry{{name: "mimetype", content: epubMimetype, method: zip.Deflate}}, conforming[1:]...),
+		"mimetype last":       append(append([]zipEntry{}, conforming[1:]...), conforming[0]),
+		"no mimetype":         conforming[1:],
+		"mimetype only": {
+			{name: "content.opf", content: opf, method: zip.Deflate},
+			{name: "mimetype", content: epubMimetype + "\n", method: zip.Deflate},
+		},
+	}
+}
+
+// Epubs with the mimetype entry out of place or compressed are still read
+// as epubs, but --native-detect holds them to the spec.
+func TestMisplacedMimetype(t *testing.T) {
+	dir := t.TempDir()
+	for name, entries := range misplacedMimetypeEntries() {
+		path := writeEpub(t, dir, name+".epub", entries)
+
+		if !hasEpubStructure(openTestZip(t, entries)) {
+			t.Errorf("%s: not recognised as an epub structure", name)
+		}
+		if name == "mimetype only" {
+			// there is no container.xml to find the OPF with
+			continue
+		}
+
+		data, ext, err := readBook(path, path, &options{})
+		if err != nil || ext != ".epub" || data.Title != "Moby Dick" {
+			t.Errorf("%s: got %q, %q (%v), want the epub's title", name, data.Title, ext, err)
+		}
+		if _, _, err := readBook(path, path, &options{nativeDetect: true}); err == nil {
+			t.Errorf("%s: accepted with --native-detect", name)
+		}
+	}
+
+	plain := writeEpub(t, dir, "plain.zip", []zipEntry{{name: "notes.txt", content: "not a book", method: zip.Deflate}})
+	if _, _, err := readBook(plain, plain, &options{}); err == nil {
+		t.Error("a plain zip was read as an epub")
+	}
+}
+
+// BenchmarkReadMisplacedMimetype measures the fallback for epubs sniffed as
+// plain zips against a conforming epub, which doesn't need it.
+func BenchmarkReadMisplacedMimetype(b *testing.B) {
+	dir := b.TempDir()
+	conforming := writeEpub(b, dir, "conforming.epub", epubEntries("content.opf", testOPF("Moby Dick", "Herman Melville", "")))
+	b.Run("conforming", func(b *testing.B) {
+		benchmarkReadBook(b, conforming, &options{})
+	})
+
+	for _, name := range []string{"compressed mimetype", "mimetype last", "no mimetype"} {
+		path := writeEpub(b, dir, name+".epub", misplacedMimetypeEntries()[name])
+		b.Run(strings.ReplaceAll(name, " ", "-"), func(b *testing.B) {
+			benchmarkReadBook(b, path, &options{})
+		})
+	}
+	plain := writeEpub(b, dir, "plain.zip", []zipEntry{{name: "notes.txt", content: "not a book", method: zip.Deflate}})
+	b.Run("plain-zip", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, _, err := readBook(plain, plain, &options{}); err == nil {
+				b.Fatal("a plain zip was read as an epub")
+			}
+		}
+	})
+}
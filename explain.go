@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// printExplanation shows, for --explain, each metadata field of result as
+// read and as the sanitizer turns it into part of a file name: the way
+// template output is cleaned up when there is a --template, and the way the
+// default Title-Author name treats its fields otherwise.
+func printExplanation(w io.Writer, result *Result, opts *options) {
+	fmt.Fprintf(w, "%s:\n", result.File)
+	if result.Data == nil {
+		return
+	}
+
+	v := reflect.ValueOf(*result.Data)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if v.Field(i).Kind() == reflect.Map {
+			continue
+		}
+
+		raw := csvValue(v.Field(i))
+		if raw == "" {
+			continue
+		}
+
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+
+		var sanitized string
+		switch {
+		case opts.template != nil:
+			sanitized = opts.sanitizer.rendered(raw, "")
+		case name == "author":
+			sanitized = opts.sanitizer.field(raw, "")
+		default:
+			sanitized = opts.sanitizer.field(raw, "_")
+		}
+
+		fmt.Fprintf(w, "  %s: %q -> %q\n", name, raw, sanitized)
+	}
+}
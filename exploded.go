@@ -0,0 +1,101 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// isExplodedEpub reports whether dir is an unzipped epub: a directory with
+// the mimetype file and container of an epub at its root.
+func isExplodedEpub(dir string) bool {
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return false
+	}
+
+	if info, err := os.Stat(filepath.Join(dir, "mimetype")); err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+
+	_, err := os.Stat(filepath.Join(dir, filepath.FromSlash(containerPath)))
+	return err == nil
+}
+
+// processExploded zips up the unzipped epub in dir and processes that, so
+// the book is written to the output directory as a regular epub.
+func processExploded(ctx context.Context, dir string, opts *options) Result {
+	path, err := zipDirectory(dir)
+	if err != nil {
+		return failed(dir, errors.New(dir+": "+err.Error()))
+	}
+	defer os.Remove(path)
+
+	return process(ctx, dir, path, opts)
+}
+
+// zipDirectory writes the files beneath dir to a temporary epub. The
+// mimetype file goes first and uncompressed, as the epub spec requires.
+func zipDirectory(dir string) (string, error) {
+	f, err := os.CreateTemp("", "epub-renamer-*.epub")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if err = writeEpubZip(f, dir); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+func writeEpubZip(w io.Writer, dir string) error {
+	zw := zip.NewWriter(w)
+
+	if err := addZipFile(zw, filepath.Join(dir, "mimetype"), &zip.FileHeader{Name: "mimetype", Method: zip.Store}); err != nil {
+		return err
+	}
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		if name == "mimetype" {
+			return nil
+		}
+
+		return addZipFile(zw, path, &zip.FileHeader{Name: name, Method: zip.Deflate})
+	})
+	if err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+func addZipFile(zw *zip.Writer, path string, header *zip.FileHeader) error {
+	fin, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fin.Close()
+
+	fout, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(fout, fin)
+	return err
+}
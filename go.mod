@@ -5,9 +5,11 @@ go 1.20
 require github.com/fatih/color v1.15.0
 
 require (
+	github.com/fsnotify/fsnotify v1.6.0
 	github.com/gabriel-vasile/mimetype v1.4.2
 	github.com/mattn/go-colorable v0.1.13 // indirect
-	github.com/mattn/go-isatty v0.0.17 // indirect
-	golang.org/x/net v0.8.0 // indirect
+	github.com/mattn/go-isatty v0.0.17
+	golang.org/x/net v0.8.0
 	golang.org/x/sys v0.6.0 // indirect
+	golang.org/x/text v0.8.0
 )
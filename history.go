@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// history appends a line per processed file to the --history file. Unlike
+// --report it outlives the run: every run appends to the same file, under a
+// run id of its own, so the file records everything done to a library over
+// time.
+type history struct {
+	path  string
+	runID string
+
+	// mu serialises this process's workers; lockFile keeps other processes
+	// appending to the same file from interleaving with them
+	mu sync.Mutex
+}
+
+type historyEntry struct {
+	Time   string `json:"time"`
+	RunID  string `json:"run_id"`
+	Source string `json:"source"`
+	Target string `json:"target,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func newHistory(path string) (*history, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	// open the file now so that a bad path is reported before any work is
+	// done rather than once per file
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+
+	return &history{path: path, runID: hex.EncodeToString(id)}, nil
+}
+
+// record appends result to the history file. Files that weren't processed
+// because the run was aborted are not recorded.
+func (h *history) record(result *Result) error {
+	if errors.Is(result.Err, errAborted) {
+		return nil
+	}
+
+	entry := historyEntry{
+		Time:   time.Now().Format(time.RFC3339),
+		RunID:  h.runID,
+		Source: result.File,
+		Target: result.Target,
+		Status: result.Status.String(),
+	}
+	if result.Err != nil {
+		entry.Error = result.Err.Error()
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	f, err := os.OpenFile(h.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err = lockFile(f); err != nil {
+		return err
+	}
+	defer unlockFile(f)
+
+	_, err = f.Write(line)
+	return err
+}
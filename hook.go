@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+)
+
+// hookResult is the outcome of the --exec command for one file.
+type hookResult struct {
+	ExitCode int    `json:"exit_code"`
+	Error    string `json:"error,omitempty"`
+}
+
+func (h *hookResult) failed() bool {
+	return h != nil && (h.ExitCode != 0 || h.Error != "")
+}
+
+type hook struct {
+	// args is the --exec command split into words. Placeholders are
+	// expanded per word, so values containing spaces stay one argument and
+	// no shell is involved.
+	args []string
+	// slots bounds how many hooks run at once
+	slots chan struct{}
+}
+
+func newHook(command string, concurrency int) *hook {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	return &hook{args: strings.Fields(command), slots: make(chan struct{}, concurrency)}
+}
+
+// run executes the hook for a successfully placed file.
+func (h *hook) run(ctx context.Context, res *Result) *hookResult {
+	h.slots <- struct{}{}
+	defer func() { <-h.slots }()
+
+	args := make([]string, len(h.args))
+	for i, arg := range h.args {
+		args[i] = expandPlaceholders(arg, res)
+	}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return &hookResult{}
+	case errors.As(err, &exitErr):
+		return &hookResult{ExitCode: exitErr.ExitCode()}
+	}
+
+	return &hookResult{ExitCode: -1, Error: err.Error()}
+}
+
+// expandPlaceholders replaces {source}, {target} and {<field>} for every
+// BookData json field name (e.g. {title}, {isbn}) in arg.
+func expandPlaceholders(arg string, res *Result) string {
+	if !strings.Contains(arg, "{") {
+		return arg
+	}
+
+	pairs := []string{"{source}", res.File, "{target}", res.Target}
+	if res.Data != nil {
+		v := reflect.ValueOf(*res.Data)
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+			pairs = append(pairs, "{"+name+"}", csvValue(v.Field(i)))
+		}
+	}
+
+	return strings.NewReplacer(pairs...).Replace(arg)
+}
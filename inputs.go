@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// walker collects the input files named on the command line and found in
+// the directories walked for --recursive.
+type walker struct {
+	followSymlinks bool
+	exts           extensions
+	// visited holds every directory walked so far. Following symlinks can
+	// lead back to a directory already seen (a link to a parent, or two
+	// links to the same place), and each is only walked once.
+	visited []os.FileInfo
+	files   []string
+}
+
+// expandInputs replaces directories in paths with the files matching exts
+// found beneath them when recursive is set. Unzipped epubs are kept as
+// inputs rather than walked. Other paths are passed through,
+// with symlinks resolved to their targets when followSymlinks is set.
+func expandInputs(paths []string, recursive bool, followSymlinks bool, exts extensions) []string {
+	w := walker{followSymlinks: followSymlinks, exts: exts}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil || !info.IsDir() || !recursive || isExplodedEpub(path) {
+			// let the worker report anything that isn't usable
+			w.add(path)
+			continue
+		}
+
+		w.walk(path, info)
+	}
+
+	return w.files
+}
+
+func (w *walker) add(path string) {
+	if w.followSymlinks {
+		if resolved, err := filepath.EvalSymlinks(path); err == nil {
+			path = resolved
+		}
+	}
+
+	w.files = append(w.files, path)
+}
+
+func (w *walker) walk(dir string, info os.FileInfo) {
+	for _, seen := range w.visited {
+		if os.SameFile(seen, info) {
+			return
+		}
+	}
+	w.visited = append(w.visited, info)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Print(err.Error())
+		return
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+
+		if entry.Type()&os.ModeSymlink != 0 {
+			target, err := os.Stat(path)
+			if err != nil {
+				log.Print(err.Error())
+				continue
+			}
+
+			if target.IsDir() {
+				if w.followSymlinks {
+					w.walk(path, target)
+				}
+				continue
+			}
+		} else if entry.IsDir() {
+			if isExplodedEpub(path) {
+				w.add(path)
+				continue
+			}
+
+			info, err := entry.Info()
+			if err != nil {
+				log.Print(err.Error())
+				continue
+			}
+
+			w.walk(path, info)
+			continue
+		}
+
+		if w.exts.matches(path) {
+			w.add(path)
+		}
+	}
+}
+
+// extensions is the repeatable --input-ext flag. Extensions are matched
+// case-insensitively against the end of the name, so multi-part ones such
+// as .kepub.epub work.
+type extensions []string
+
+// defaultExtensions is used when --input-ext isn't given.
+var defaultExtensions = extensions{".epub"}
+
+func (e *extensions) String() string {
+	return strings.Join(*e, ",")
+}
+
+func (e *extensions) Set(value string) error {
+	if value == "" || value == "." {
+		return errors.New("empty extension")
+	}
+	if !strings.HasPrefix(value, ".") {
+		value = "." + value
+	}
+
+	*e = append(*e, value)
+	return nil
+}
+
+func (e extensions) matches(name string) bool {
+	for _, ext := range e {
+		if len(name) > len(ext) && strings.EqualFold(name[len(name)-len(ext):], ext) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// markDuplicates marks the jobs whose input resolves to the same file as an
+// earlier job's, so that two workers don't race to write the same output.
+// The marked jobs are returned.
+func markDuplicates(jobs []job) []job {
+	var duplicates []job
+	seen := map[string]string{}
+	for i := range jobs {
+		if jobs[i].filename != "" || jobs[i].path != "" {
+			continue
+		}
+
+		key := jobs[i].file
+		if !isURL(key) {
+			if abs, err := filepath.Abs(key); err == nil {
+				key = abs
+			}
+			if resolved, err := filepath.EvalSymlinks(key); err == nil {
+				key = resolved
+			}
+		}
+
+		if first, ok := seen[key]; ok {
+			jobs[i].duplicateOf = first
+			duplicates = append(duplicates, jobs[i])
+			continue
+		}
+		seen[key] = jobs[i].file
+	}
+
+	return duplicates
+}
+
+// limitJobs returns the jobs up to the nth that isn't a duplicate; the
+// duplicates marked along the way don't count towards n.
+func limitJobs(jobs []job, n int) []job {
+	for i := range jobs {
+		if jobs[i].duplicateOf != "" {
+			continue
+		}
+		if n--; n == 0 {
+			return jobs[:i+1]
+		}
+	}
+
+	return jobs
+}
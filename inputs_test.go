@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The same file named twice, whether by the same path, a path with extra
+// components or a symlink, is only processed the first time.
+func TestMarkDuplicates(t *testing.T) {
+	dir := t.TempDir()
+	book := filepath.Join(dir, "book.epub")
+	other := filepath.Join(dir, "other.epub")
+	for _, path := range []string{book, other} {
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	link := filepath.Join(dir, "link.epub")
+	if err := os.Symlink(book, link); err != nil {
+		t.Fatal(err)
+	}
+
+	jobs := []job{
+		{file: book},
+		{file: other},
+		{file: book},
+		{file: filepath.Join(dir, ".", "sub", "..", "book.epub")},
+		{file: link},
+	}
+	duplicates := markDuplicates(jobs)
+
+	if len(duplicates) != 3 {
+		t.Fatalf("got %d duplicates, want 3", len(duplicates))
+	}
+	for i, want := range []string{"", "", book, book, book} {
+		if jobs[i].duplicateOf != want {
+			t.Errorf("%s: got duplicate of %q, want %q", jobs[i].file, jobs[i].duplicateOf, want)
+		}
+	}
+}
+
+// --limit counts the inputs that will be processed, not the duplicates
+// skipped among them.
+func TestLimitJobsSkipsDuplicates(t *testing.T) {
+	jobs := []job{
+		{file: "a.epub"},
+		{file: "a.epub", duplicateOf: "a.epub"},
+		{file: "b.epub"},
+		{file: "b.epub", duplicateOf: "b.epub"},
+		{file: "c.epub"},
+	}
+
+	for _, test := range []struct {
+		n    int
+		want int
+	}{{1, 1}, {2, 3}, {3, 5}, {4, 5}} {
+		if got := limitJobs(jobs, test.n); len(got) != test.want {
+			t.Errorf("limit %d: got %d jobs, want %d", test.n, len(got), test.want)
+		}
+	}
+}
@@ -2,162 +2,984 @@ package main
 
 import (
 	"archive/zip"
-	"encoding/xml"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
-	"regexp"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
 
 	"github.com/fatih/color"
 	"github.com/gabriel-vasile/mimetype"
 )
 
-type BookData struct {
-	Title  string `xml:"metadata>title"`
-	Author string `xml:"metadata>creator"`
+// the --order modes
+const (
+	orderStream = "stream"
+	orderSorted = "sorted"
+)
+
+// exit statuses, documented in usage()
+const (
+	exitOK         = 0
+	exitSomeFailed = 1
+	exitUsage      = 2
+	exitAllFailed  = 3
+	exitDeclined   = 4
+)
+
+type options struct {
+	// outputDirectory is empty in --in-place mode
+	outputDirectory string
+	inPlace         bool
+	// move removes each local input once it has been written to the output
+	// directory
+	move bool
+	// symlink links each target to its source instead of copying it, with a
+	// relative link when linkRelative is set
+	symlink      bool
+	linkRelative bool
+	// nativeDetect decides whether a file is an epub from its zip structure
+	// alone, without content sniffing; other formats aren't recognised
+	nativeDetect bool
+	// writeOPF writes an OPF sidecar with the metadata next to every placed
+	// book, for Calibre to import
+	writeOPF bool
+	// verify compares the checksum of every written file with its source. With
+	// move, the source is only removed once its copy has been verified,
+	// unless keepSourceOnVerifyFail is false.
+	verify                 bool
+	keepSourceOnVerifyFail bool
+	// dryRun resolves every target without writing anything
+	dryRun   bool
+	resolver targetResolver
+	template *template.Template
+	// dirTemplate, from --dir-template, names the directories the file
+	// named by template (or the default naming) goes in
+	dirTemplate *template.Template
+	sanitizer   sanitizer
+	// setTitle and setAuthor replace the parsed metadata when not empty
+	setTitle  string
+	setAuthor string
+	// sortTitle names files by the sort title ("Hobbit, The")
+	sortTitle bool
+	// caser recases the title, author and series before naming
+	caser caser
+	// downloadTimeout bounds fetching http(s) inputs
+	downloadTimeout time.Duration
+	placeholders    placeholders
+	metadata        metadataOptions
+	// hook is run after every successful file when --exec is given
+	hook *hook
+	// history, when set, gets a line for every processed file
+	history *history
+	// minChapters skips books whose spine is shorter, such as pamphlets and
+	// samples
+	minChapters int
+	// known are the --skip-known identifiers of books already imported
+	known knownIDs
+	// existing is set by --replace-existing-only: only books with a copy in
+	// the output directory are written, and that copy is replaced
+	existing outputIndex
+	// quietSkips leaves skipped files out of the per-file lines
+	quietSkips bool
+	// failuresOnly leaves successful and planned files out of them too
+	failuresOnly bool
+	// inputExts are the extensions of the files picked up from directories
+	inputExts extensions
+	// workers is how many files are read at once, 0 for all of them
+	workers int
+	// ioSlots bounds how many files are copied at once, so that metadata
+	// can be read in parallel while a spinning disk is written serially.
+	// It is nil when --io-concurrency isn't limited.
+	ioSlots chan struct{}
 }
 
-type EpubMetadataParseError struct{}
+var errAborted = errors.New("not processed: run aborted")
+
+// errOutputGone is returned for every file once the output directory has
+// been removed from under the run.
+var errOutputGone = errors.New("the output directory disappeared")
+
+// errEmptyName is returned for books whose name renders to nothing but the
+// extension.
+var errEmptyName = errors.New("empty output filename... aborting")
+
+type status int
+
+const (
+	statusFailed status = iota
+	statusSucceeded
+	statusSkipped
+	// statusPlanned is a file that --dry-run would have written to Target
+	statusPlanned
+)
+
+type Result struct {
+	File   string
+	Target string
+	Status status
+	Err    error
+	// Data is nil when the file's metadata couldn't be read
+	Data *BookData
+	// Hook is the outcome of --exec, nil when it didn't run
+	Hook *hookResult
+	// Warnings describe metadata that was usable but incomplete, such as a
+	// missing author replaced by a placeholder
+	Warnings []string
+
+	// path is where File can be read locally, which differs from File for
+	// downloaded URLs
+	path string
+	// replaces is set for a planned target that already exists and would
+	// be overwritten
+	replaces bool
+	// kept is the existing file that caused a skip under the conflict
+	// policy, or the input itself when it already has its name
+	kept string
+	// spool and digest are the copy readNamed made of path and its
+	// SHA-256, when it made one
+	spool  string
+	digest string
+}
 
-func (e *EpubMetadataParseError) Error() string {
-	return "failed to find epub opf"
+func (opts *options) applyOverrides(data *BookData) {
+	if opts.setTitle != "" {
+		data.Title = opts.setTitle
+	}
+	if opts.setAuthor != "" {
+		data.Author = opts.setAuthor
+		data.Authors = []string{opts.setAuthor}
+	}
 }
 
-func parseContentOPF(rc io.ReadCloser) (BookData, error) {
-	byteValue, err := io.ReadAll(rc)
+// warnings lists what is missing from data that the name is built from.
+func (opts *options) warnings(data *BookData) []string {
+	var warnings []string
+	if opts.metadata.suspicious(data.Title) {
+		warnings = append(warnings, fmt.Sprintf("title %q looks like a placeholder", data.Title))
+	}
+	for _, missing := range []struct{ name, field, value, placeholder string }{
+		{"title", "Title", data.Title, opts.placeholders.title},
+		{"author", "Author", data.Author, opts.placeholders.author},
+	} {
+		switch {
+		case missing.value != "":
+		case opts.template == nil:
+			warnings = append(warnings, fmt.Sprintf("no %s, used %q", missing.name, missing.placeholder))
+		case opts.templateUses(missing.field):
+			warnings = append(warnings, "no "+missing.name)
+		}
+	}
+
+	return warnings
+}
+
+// templateUses reports whether --template or --dir-template uses the
+// BookData field name.
+func (opts *options) templateUses(name string) bool {
+	return templateUses(opts.template, name) || templateUses(opts.dirTemplate, name)
+}
+
+// filename computes the output file name for data, from --template when one
+// was given and as Title-Author otherwise, ending in ext. With
+// --dir-template, it is put in the directories that renders.
+func (opts *options) filename(data *BookData, ext string) (string, error) {
+	if opts.dirTemplate == nil {
+		return opts.baseName(data, ext)
+	}
+
+	name, err := opts.baseName(data, ext)
+	if err != nil || name == "" {
+		return name, err
+	}
+
+	dir, err := renderDirectory(opts.dirTemplate, opts.named(data), &opts.sanitizer)
 	if err != nil {
-		return BookData{}, err
+		return "", err
 	}
 
-	var bookData BookData
-	if err = xml.Unmarshal(byteValue, &bookData); err != nil {
-		return BookData{}, err
+	return filepath.Join(dir, name), nil
+}
+
+// named applies --sort-title and --case-style to data.
+func (opts *options) named(data *BookData) *BookData {
+	if opts.sortTitle && data.TitleSort != "" {
+		named := *data
+		named.Title = data.TitleSort
+		data = &named
 	}
 
-	return bookData, nil
+	if opts.caser.style != caseNone {
+		named := *data
+		named.Title = opts.caser.apply(named.Title)
+		named.TitleSort = opts.caser.apply(named.TitleSort)
+		named.Author = opts.caser.apply(named.Author)
+		named.Series = opts.caser.apply(named.Series)
+		data = &named
+	}
+
+	return data
 }
 
-func readEpubData(f *zip.ReadCloser) (BookData, error) {
-	for _, file := range f.File {
-		if strings.HasSuffix(file.Name, ".opf") {
-			rc, err := file.Open()
-			if err != nil {
-				return BookData{}, err
-			}
-			defer rc.Close()
+// baseName is the file name part of filename.
+func (opts *options) baseName(data *BookData, ext string) (string, error) {
+	data = opts.named(data)
+	if opts.template != nil {
+		return renderTemplate(opts.template, data, &opts.sanitizer, ext)
+	}
 
-			return parseContentOPF(rc)
+	if data.Title == "" || data.Author == "" {
+		named := *data
+		if named.Title == "" {
+			named.Title = opts.placeholders.title
+		}
+		if named.Author == "" {
+			named.Author = opts.placeholders.author
 		}
+		data = &named
 	}
 
-	return BookData{}, &EpubMetadataParseError{}
+	return opts.sanitizer.name(data, ext), nil
+}
+
+func failed(file string, err error) Result {
+	return Result{File: file, Status: statusFailed, Err: err}
+}
+
+func (r *Result) fail(err error) {
+	r.Status = statusFailed
+	r.Err = err
+}
+
+// cancel marks a file that wasn't processed because the run was aborted.
+func (r *Result) cancel() {
+	r.Status = statusSkipped
+	r.Err = errAborted
 }
 
-func sanitizeData(data *BookData) string {
-	title := regexp.MustCompile(`[^a-zA-Z0-9]+`).ReplaceAllString(data.Title, "_")
-	author := regexp.MustCompile(`[^a-zA-Z0-9]+`).ReplaceAllString(data.Author, "")
+// process names and places file, which is read from the local path.
+func process(ctx context.Context, file string, path string, opts *options) Result {
+	return processNamed(ctx, file, path, readNamed(ctx, file, path, opts), opts)
+}
 
-	return title + "-" + author + ".epub"
+// namedBook is what nameBook found for a job. The plan made for the
+// confirmation keeps it, so that the real run doesn't read the book again.
+type namedBook struct {
+	read     bool
+	data     *BookData
+	filename string
+	err      error
+	// spool is the copy of the book made in the output directory while
+	// hashing it for {{.Hash}}, which place renames into the target, and
+	// digest is its SHA-256
+	spool  string
+	digest string
 }
 
-func run(file string, outputDirectory string, result chan struct {
-	string
-	bool
-}) {
-	mtype, err := mimetype.DetectFile(file)
+// readNamed runs nameBook on file. When the name needs the content hash and
+// the file is going to be copied anyway, the copy is made first and hashed
+// as it is written, so that the book is only read in full once.
+func readNamed(ctx context.Context, file string, path string, opts *options) namedBook {
+	if !opts.templateUses("Hash") || !opts.copiesSource(file, path) {
+		data, filename, err := nameBook(file, path, "", opts)
+		return namedBook{read: true, data: data, filename: filename, err: err}
+	}
+
+	release, ok := opts.acquireIO(ctx)
+	if !ok {
+		// processNamed reports the cancellation
+		return namedBook{read: true, err: ctx.Err()}
+	}
+	spool, digest, err := spoolCopy(path, opts.outputDirectory)
+	release()
 	if err != nil {
-		log.Print(err.Error())
-		result <- struct {
-			string
-			bool
-		}{file, false}
+		return namedBook{read: true, err: errors.New(file + ": " + err.Error())}
+	}
+
+	data, filename, err := nameBook(file, path, digest[:8], opts)
+	return namedBook{read: true, data: data, filename: filename, err: err, spool: spool, digest: digest}
+}
+
+// copiesSource reports whether place writes a copy of path to the output
+// directory, rather than linking or renaming it or writing nothing.
+func (opts *options) copiesSource(file string, path string) bool {
+	return !opts.dryRun && opts.outputDirectory != "" && !opts.symlink && !opts.inPlace && !(opts.move && path == file)
+}
+
+// spoolCopy copies path to a temporary file in dir, returning the copy and
+// the SHA-256 of the contents.
+func spoolCopy(path string, dir string) (spool string, digest string, err error) {
+	f, err := os.CreateTemp(dir, ".epub-renamer-*")
+	if err != nil {
+		return "", "", err
+	}
+	spool = f.Name()
+	f.Close()
+
+	if digest, err = copyFile(path, spool); err != nil {
+		os.Remove(spool)
+		return "", "", err
+	}
+
+	return spool, digest, nil
+}
+
+// processNamed places file under the name nameBook computed for it.
+func processNamed(ctx context.Context, file string, path string, named namedBook, opts *options) Result {
+	if named.spool != "" {
+		// gone already once place has renamed it
+		defer os.Remove(named.spool)
+	}
+
+	data, filename, err := named.data, named.filename, named.err
+	res := Result{File: file, Data: data, path: path, spool: named.spool, digest: named.digest}
+	if ctx.Err() != nil {
+		res.cancel()
+		return res
+	}
+	// only epubs have a spine; the other formats leave ChapterCount at 0
+	if data != nil && data.ChapterCount > 0 && data.ChapterCount < opts.minChapters {
+		res.Status = statusSkipped
+		res.Err = fmt.Errorf("%s: %d chapters, fewer than --min-chapters", file, data.ChapterCount)
+		return res
+	}
+	if data != nil && opts.known != nil {
+		if id := opts.known.match(data); id != "" {
+			res.Status = statusSkipped
+			res.Err = errors.New(file + ": skipped, known (" + id + ")")
+			return res
+		}
+	}
+	if errors.Is(err, errEmptyName) && opts.dryRun {
+		// a real run would fail here; flag it so the template can be fixed
+		res.Status = statusSkipped
+		res.Err = fmt.Errorf("would be skipped: %w", err)
+		return res
+	} else if err != nil {
+		res.fail(err)
+		return res
+	}
+	res.Warnings = opts.warnings(data)
+
+	var replaced string
+	if opts.existing != nil {
+		if replaced = opts.existing.match(data); replaced == "" {
+			res.Status = statusSkipped
+			res.Err = errors.New(file + ": no copy of this book in the output directory")
+			return res
+		}
+	}
+
+	place(ctx, &res, filename, opts)
+	if opts.writeOPF && res.Status == statusSucceeded {
+		if err := writeSidecar(sidecarPath(res.Target), data); err != nil {
+			res.Warnings = append(res.Warnings, "couldn't write the OPF sidecar: "+err.Error())
+		}
+	}
+	if replaced != "" && res.Status == statusSucceeded && !sameFile(replaced, res.Target) {
+		// the better named copy is in place, so the old one goes
+		if err := os.Remove(replaced); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			res.Warnings = append(res.Warnings, "couldn't remove the replaced "+replaced+": "+err.Error())
+		}
+	}
+	return res
+}
+
+// nameBook reads the metadata of file from the local path and computes its
+// output file name. data is nil when the metadata couldn't be read. hash is
+// the content hash for {{.Hash}} when the caller already has it.
+func nameBook(file string, path string, hash string, opts *options) (data *BookData, filename string, err error) {
+	book, ext, err := bookReader(file, path, opts)
+	if err != nil {
+		return nil, "", err
+	}
+
+	opts.applyOverrides(&book)
+
+	if opts.templateUses("Hash") {
+		if hash == "" {
+			// nothing copies the file before it is named, so this is a
+			// read of its own
+			if hash, err = fileHash(path); err != nil {
+				return &book, "", errors.New(file + ": " + err.Error())
+			}
+		}
+		book.Hash = hash
+	}
+
+	filename, err = opts.filename(&book, ext)
+	if err != nil {
+		return &book, "", errors.New(file + ": " + err.Error())
+	}
+	if filename == "" {
+		return &book, "", errEmptyName
+	}
+
+	return &book, filename, nil
+}
+
+// fileHash returns the first 8 hex digits of the SHA-256 of the file at
+// path.
+func fileHash(path string) (string, error) {
+	digest, err := fileDigest(path)
+	if err != nil {
+		return "", err
+	}
+
+	return digest[:8], nil
+}
+
+// fileDigest returns the hex encoded SHA-256 of the file at path.
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// bookReader is the parser nameBook reads metadata with, which tests
+// replace with a stub.
+var bookReader = readBook
+
+// readBook reads the metadata of file, returning the extension its output
+// should have: .epub, or that of the office document or Kindle book it
+// turned out to be.
+func readBook(file string, path string, opts *options) (BookData, string, error) {
+	if opts.nativeDetect {
+		return readStrictEpub(file, path, opts)
+	}
+
+	mtype, err := mimetype.DetectFile(path)
+	if err != nil {
+		return BookData{}, "", err
+	}
+
+	if mtype.String() == mobiMimetype {
+		return readMobiData(file, path)
+	}
+
+	office := officeFormats[mtype.String()]
+	if mtype.String() != epubMimetype && mtype.String() != "application/zip" && office == nil {
+		return BookData{}, "", errors.New(file + ": not an epub file")
+	}
+
+	f, err := zip.OpenReader(path)
+	if err != nil {
+		return BookData{}, "", err
+	}
+	defer f.Close()
+
+	if mtype.String() == "application/zip" && !hasEpubStructure(&f.Reader) {
+		if office = detectOfficeFormat(&f.Reader); office == nil {
+			return BookData{}, "", errors.New(file + ": not an epub file")
+		}
+	}
+
+	var data BookData
+	ext := ".epub"
+	if office != nil {
+		data, err = readOfficeData(&f.Reader, office, &opts.metadata)
+		ext = office.ext
+	} else {
+		data, err = readEpubData(file, f, &opts.metadata)
+	}
+	if err != nil {
+		return BookData{}, "", errors.New(file + ": " + err.Error())
+	}
+
+	return data, ext, nil
+}
+
+// readStrictEpub is readBook for --native-detect, which only takes files
+// that pass isStrictEpub.
+func readStrictEpub(file string, path string, opts *options) (BookData, string, error) {
+	f, err := zip.OpenReader(path)
+	if err != nil {
+		return BookData{}, "", errors.New(file + ": not an epub file")
+	}
+	defer f.Close()
+
+	if !isStrictEpub(&f.Reader) {
+		return BookData{}, "", errors.New(file + ": not an epub file")
+	}
+
+	data, err := readEpubData(file, f, &opts.metadata)
+	if err != nil {
+		return BookData{}, "", errors.New(file + ": " + err.Error())
+	}
+
+	return data, ".epub", nil
+}
+
+// processMapped places file under the name given for it in a --map file,
+// without looking at its metadata.
+// When nested, filename may be a path beneath the output directory.
+func processMapped(ctx context.Context, file string, filename string, nested bool, opts *options) Result {
+	res := Result{File: file, path: file}
+	if err := validateMappedName(filename); err != nil && !nested {
+		res.fail(errors.New(file + ": " + err.Error()))
+		return res
+	}
+
+	place(ctx, &res, filename, opts)
+	return res
+}
+
+// place copies (or in --in-place mode renames) res.File to filename in the
+// output directory, applying the conflict policy and recording the outcome
+// in res.
+func place(ctx context.Context, res *Result, filename string, opts *options) {
+	file := res.File
+	if ctx.Err() != nil {
+		res.cancel()
 		return
 	}
 
-    fmt.Println(mtype.String());
-	if mtype.String() != "application/epub+zip" && mtype.String() != "application/zip" {
-		log.Print(file + ": not an epub file")
-		result <- struct {
-			string
-			bool
-		}{file, false}
+	outputDirectory := opts.outputDirectory
+	if opts.inPlace {
+		if res.path != file {
+			res.fail(errors.New(file + ": only local files can be renamed in place"))
+			return
+		}
+		outputDirectory = filepath.Dir(file)
+	}
+
+	target := filepath.Join(outputDirectory, filename)
+	if !withinDirectory(outputDirectory, target) {
+		res.fail(errors.New(file + ": output path " + target + " escapes " + outputDirectory))
 		return
 	}
 
-	var data BookData
-	{
-		f, err := zip.OpenReader(file)
-		if err != nil {
-			log.Print(err.Error())
-			result <- struct {
-				string
-				bool
-			}{file, false}
+	if !opts.dryRun {
+		// MkdirAll would quietly recreate a removed output directory
+		if opts.outputGone() {
+			res.fail(errOutputGone)
 			return
 		}
-		defer f.Close()
 
-		data, err = readEpubData(f)
-		if err != nil {
-			log.Print(file + ": " + err.Error())
-			result <- struct {
-				string
-				bool
-			}{file, false}
+		// --template may put the file in subdirectories
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			res.fail(err)
 			return
 		}
 	}
 
-	filename := sanitizeData(&data)
-	if filename == "" {
-		log.Print("empty output filename... aborting")
-		result <- struct {
-			string
-			bool
-		}{file, false}
+	label := collisionLabel(opts.resolver.suffix, res.Data)
+	if opts.resolver.policy == conflictKeepSourceDir {
+		label = filepath.Base(filepath.Dir(file))
+	}
+	label = strings.Trim(opts.sanitizer.field(label, "_"), "_")
+	wanted := target
+	target, err := opts.resolver.resolve(target, res.path, label, !opts.dryRun)
+	if err != nil && opts.outputGone() {
+		res.fail(errOutputGone)
+		return
+	} else if err != nil {
+		res.fail(err)
+		return
+	}
+	if target == "" {
+		res.kept = wanted
+		res.Status = statusSkipped
 		return
 	}
 
-	fout, err := os.Create(outputDirectory + "/" + filename)
-	if err != nil {
-		log.Print(err.Error())
-		result <- struct {
-			string
-			bool
-		}{file, false}
+	placed := false
+	if !opts.dryRun && opts.resolver.policy != conflictOverwrite {
+		// don't leave the empty file reserve created behind when a panic
+		// unwinds past here
+		defer func() {
+			if r := recover(); r != nil {
+				if !placed {
+					os.Remove(target)
+				}
+				panic(r)
+			}
+		}()
+	}
+
+	if opts.dryRun {
+		res.replaces, _ = opts.resolver.exists(target)
+		res.Target = target
+		res.Status = statusPlanned
 		return
 	}
+
+	release, ok := opts.acquireIO(ctx)
+	if !ok {
+		if opts.resolver.policy != conflictOverwrite {
+			os.Remove(target)
+		}
+		res.cancel()
+		return
+	}
+	defer release()
+
+	moving := opts.move && res.path == file
+	switch {
+	case opts.symlink && res.path != file:
+		err = errors.New(file + ": only local files can be linked to")
+	case opts.symlink:
+		err = linkFile(file, target, opts.linkRelative)
+	case opts.inPlace:
+		err = moveFile(file, target)
+	case moving && opts.verify:
+		var digest string
+		digest, err = copyFile(file, target)
+		if err == nil {
+			err = verifyCopy(file, digest, target)
+		}
+		if err == nil || !opts.keepSourceOnVerifyFail && errors.Is(err, errChecksum) {
+			if removeErr := os.Remove(file); err == nil {
+				err = removeErr
+			}
+		}
+	case moving:
+		err = moveFile(file, target)
+	default:
+		digest := res.digest
+		if res.spool != "" {
+			err = moveFile(res.spool, target)
+		} else {
+			digest, err = copyFile(res.path, target)
+		}
+		if err == nil && opts.verify {
+			err = verifyCopy(res.path, digest, target)
+		}
+	}
+	if errors.Is(err, errChecksum) {
+		if !moving || opts.keepSourceOnVerifyFail {
+			// the source is still there, so the bad copy is of no use
+			os.Remove(target)
+		}
+		res.fail(err)
+		return
+	} else if err != nil {
+		if opts.resolver.policy != conflictOverwrite {
+			// don't leave the reserved, possibly partial, file behind
+			os.Remove(target)
+		}
+		if opts.outputGone() {
+			err = errOutputGone
+		}
+		res.fail(err)
+		return
+	}
+
+	placed = true
+	res.Target = target
+	res.Status = statusSucceeded
+}
+
+// outputGone reports whether the output directory checked at startup no
+// longer exists.
+func (opts *options) outputGone() bool {
+	if opts.outputDirectory == "" {
+		return false
+	}
+
+	_, err := os.Stat(opts.outputDirectory)
+	return errors.Is(err, fs.ErrNotExist)
+}
+
+// acquireIO takes one of the --io-concurrency slots, returning the function
+// that gives it back. ok is false when ctx is done first.
+func (opts *options) acquireIO(ctx context.Context) (release func(), ok bool) {
+	if opts.ioSlots == nil || opts.inPlace {
+		return func() {}, true
+	}
+
+	select {
+	case opts.ioSlots <- struct{}{}:
+		return func() { <-opts.ioSlots }, true
+	case <-ctx.Done():
+		return nil, false
+	}
+}
+
+// copyFile copies source to target and returns the hex encoded SHA-256 of
+// what it read, for --verify and {{.Hash}}.
+func copyFile(source string, target string) (digest string, err error) {
+	fout, err := os.Create(target)
+	if err != nil {
+		return "", err
+	}
 	defer fout.Close()
 
-	fin, err := os.Open(file)
+	fin, err := os.Open(source)
 	if err != nil {
-		log.Print(err.Error())
-		result <- struct {
-			string
-			bool
-		}{file, false}
-		return
+		return "", err
 	}
 	defer fin.Close()
 
-	_, err = io.Copy(fout, fin)
+	h := sha256.New()
+	if _, err = copyData(fout, io.TeeReader(fin, h)); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// copyData does the copying for copyFile; benchmarks replace it to simulate
+// a slow disk.
+var copyData = io.Copy
+
+// linkFile makes target a symlink to source, replacing the empty file the
+// resolver may have reserved. A relative link keeps working when the output
+// directory and the originals are moved together.
+func linkFile(source string, target string, relative bool) error {
+	link, err := filepath.Abs(source)
 	if err != nil {
-		log.Print(err.Error())
-		result <- struct {
-			string
-			bool
-		}{file, false}
-		return
+		return err
+	}
+
+	if relative {
+		dir, err := filepath.Abs(filepath.Dir(target))
+		if err != nil {
+			return err
+		}
+		if link, err = filepath.Rel(dir, link); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Remove(target); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
 	}
 
-	result <- struct {
-		string
-		bool
-	}{file, true}
+	return os.Symlink(link, target)
 }
 
+var errChecksum = errors.New("checksum mismatch")
+
+// verifyCopy checks that target has the same contents as source, whose
+// SHA-256 want was taken as it was copied.
+func verifyCopy(source string, want string, target string) error {
+	got, err := fileDigest(target)
+	if err != nil {
+		return err
+	}
+
+	if got != want {
+		return fmt.Errorf("%s: %w after writing %s", source, errChecksum, target)
+	}
+
+	return nil
+}
+
+// moveFile renames source to target, falling back to a copy and delete when
+// they are on different filesystems.
+func moveFile(source string, target string) error {
+	err := os.Rename(source, target)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	if _, err = copyFile(source, target); err != nil {
+		return err
+	}
+
+	return os.Remove(source)
+}
+
+// withinDirectory reports whether path lies strictly beneath dir. Sanitized
+// names can't contain separators, but this is the last line of defence
+// before anything is written.
+func withinDirectory(dir string, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == "." || filepath.IsAbs(rel) {
+		return false
+	}
+
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+type job struct {
+	file string
+	// filename is set for --map entries and overrides the computed name
+	filename string
+	// nested allows filename to be a path beneath the output directory,
+	// for the targets of a dry-run plan made with subdirectories
+	nested bool
+	// path is set for --from-archive entries, which are read from a
+	// temporary file removed once the job is done
+	path string
+	// duplicateOf is set when file was already given as another input, and
+	// is that input
+	duplicateOf string
+	// named is set for the jobs planRun reads the metadata of, and is
+	// filled in by the first of the plan and the real run to get there
+	named *namedBook
+}
+
+// process dispatches j to the function handling its kind of input. A panic
+// while processing j fails j alone rather than the whole run; the stack is
+// logged with --debug.
+func (j job) process(ctx context.Context, opts *options) (res Result) {
+	defer func() {
+		if r := recover(); r != nil {
+			debugLog.Printf("%s: panic: %v\n%s", j.file, r, debug.Stack())
+			res = failed(j.file, fmt.Errorf("%s: internal error: %v", j.file, r))
+		}
+	}()
+
+	switch {
+	case ctx.Err() != nil:
+		res := Result{File: j.file}
+		res.cancel()
+		return res
+	case j.duplicateOf != "":
+		return Result{File: j.file, Status: statusSkipped, Err: errors.New("duplicate of " + j.duplicateOf)}
+	case j.filename != "":
+		return processMapped(ctx, j.file, j.filename, j.nested, opts)
+	case j.named != nil:
+		path := j.path
+		if path == "" {
+			path = j.file
+		}
+		if !j.named.read {
+			*j.named = readNamed(ctx, j.file, path, opts)
+		}
+		return processNamed(ctx, j.file, path, *j.named, opts)
+	case j.path != "":
+		return process(ctx, j.file, j.path, opts)
+	case isURL(j.file):
+		return processURL(ctx, j.file, opts)
+	case isExplodedEpub(j.file):
+		return processExploded(ctx, j.file, opts)
+	}
+
+	return process(ctx, j.file, j.file, opts)
+}
+
+// forEach calls fn with every index below n, at most workers of them at
+// once (all of them when workers is 0), and returns once every call has.
+func forEach(n int, workers int, fn func(i int)) {
+	if workers <= 0 || workers > n {
+		workers = n
+	}
+
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				fn(i)
+			}
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+}
+
+func run(ctx context.Context, j job, opts *options, result chan Result) {
+	res := j.process(ctx, opts)
+	if j.path != "" {
+		os.Remove(j.path)
+	}
+	// a missing output directory is reported once, by the caller
+	if res.Status == statusFailed && !errors.Is(res.Err, errOutputGone) {
+		log.Print(res.Err.Error())
+	}
+
+	if res.Status == statusSucceeded && opts.hook != nil {
+		res.Hook = opts.hook.run(ctx, &res)
+		if res.Hook.failed() {
+			log.Print(res.File + ": --exec hook failed")
+		}
+	}
+
+	if opts.history != nil && !opts.dryRun {
+		if err := opts.history.record(&res); err != nil {
+			log.Print(res.File + ": --history: " + err.Error())
+		}
+	}
+
+	result <- res
+}
+
+// shows reports whether result gets a per-file line.
+func (opts *options) shows(result *Result) bool {
+	switch result.Status {
+	case statusSkipped:
+		return !opts.quietSkips
+	case statusSucceeded, statusPlanned:
+		return !opts.failuresOnly
+	}
+
+	return true
+}
+
+func printResult(result *Result) {
+	switch result.Status {
+	case statusSucceeded:
+		color.Green("%s: ✅", result.File)
+		if result.Hook.failed() {
+			color.Magenta("  --exec hook exited with %d %s", result.Hook.ExitCode, result.Hook.Error)
+		}
+		printWarnings(result)
+	case statusSkipped:
+		if result.Err != nil {
+			// most reasons already start with the file
+			color.Yellow("%s: ⏭ %s", result.File, strings.TrimPrefix(result.Err.Error(), result.File+": "))
+		} else {
+			color.Yellow("%s: ⏭", result.File)
+		}
+	case statusPlanned:
+		if result.replaces {
+			color.Cyan("%s -> %s (overwrites)", result.File, result.Target)
+		} else {
+			color.Cyan("%s -> %s", result.File, result.Target)
+		}
+		printWarnings(result)
+	default:
+		color.Red("%s: ❌", result.File)
+	}
+}
+
+// printWarnings writes result's warnings to stderr, so they stand apart from
+// the per-file lines on stdout without counting as failures.
+func printWarnings(result *Result) {
+	for _, warning := range result.Warnings {
+		warningColor.Fprintf(os.Stderr, "  warning: %s\n", warning)
+	}
+}
+
+var warningColor = color.New(color.FgHiYellow)
+
+// outputEnv names the output directory used when neither the arguments nor
+// --output give one.
+const outputEnv = "EPUB_RENAMER_OUTPUT"
+
 func isDirectory(path string) (bool, error) {
 	fileInfo, err := os.Stat(path)
 	if err != nil {
@@ -167,50 +989,723 @@ func isDirectory(path string) (bool, error) {
 	return fileInfo.IsDir(), nil
 }
 
+// checkWritable creates and removes a temporary file in dir, so that a
+// permission problem is reported once instead of by every worker.
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".epub-renamer-*")
+	if err != nil {
+		var pathErr *fs.PathError
+		if errors.As(err, &pathErr) {
+			// the path is already part of the message
+			return pathErr.Err
+		}
+		return err
+	}
+	f.Close()
+
+	return os.Remove(f.Name())
+}
+
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+
+	return set
+}
+
+func usage() {
+	fmt.Fprintln(flag.CommandLine.Output(), "usage:", os.Args[0], "[flags] <output_directory> <files> ...")
+	fmt.Fprintln(flag.CommandLine.Output(), "      ", os.Args[0], "[flags] --in-place <files> ...")
+	fmt.Fprintln(flag.CommandLine.Output(), "      ", os.Args[0], "[flags] --reorganize <library_directory>")
+	fmt.Fprintln(flag.CommandLine.Output(), "      ", os.Args[0], "[flags] --map <file> <output_directory>")
+	fmt.Fprintln(flag.CommandLine.Output(), "      ", os.Args[0], "[flags] --only-failed <report.json> <output_directory>")
+	fmt.Fprintln(flag.CommandLine.Output(), "      ", os.Args[0], "[flags] --watch <input_directory> <output_directory>")
+	fmt.Fprintln(flag.CommandLine.Output(), "      ", os.Args[0], "[flags] --validate <files> ...")
+	fmt.Fprintln(flag.CommandLine.Output(), "      ", os.Args[0], "[flags] --print-name <file>")
+	fmt.Fprintln(flag.CommandLine.Output(), "      ", os.Args[0], "[flags] --list-opf-path <files> ...")
+	fmt.Fprintln(flag.CommandLine.Output(), "      ", os.Args[0], "[flags] --find-duplicates <key> <files> ...")
+	fmt.Fprintln(flag.CommandLine.Output(), "      ", os.Args[0], "[flags] --from-archive <output_directory> <archives> ...")
+	flag.PrintDefaults()
+	fmt.Fprintln(flag.CommandLine.Output(), "With --output, the output directory is left out of the arguments. When it is left out without --output, "+outputEnv+" is used.")
+	fmt.Fprint(flag.CommandLine.Output(), "\n"+templateFuncsHelp)
+	fmt.Fprint(flag.CommandLine.Output(), `
+exit status:
+  0  every file succeeded or was skipped
+  1  some files failed
+  2  usage or argument error, nothing was processed
+  3  every file failed
+  4  the confirmation was declined, nothing was changed
+`)
+}
+
 func main() {
-	if len(os.Args) < 3 {
-		fmt.Println("usage:", os.Args[0], "<output_directory> <files> ...")
-		os.Exit(1)
+	opts := options{}
+
+	templateText := flag.String("template", "", "text/template used to build output filenames, e.g. {{.Title}}-{{.Author}}")
+	nameTemplate := flag.String("name-template", "", "like --template, but meant for the file name alone, with --dir-template naming the directories")
+	dirTemplate := flag.String("dir-template", "", "text/template naming the directories files go in, e.g. {{.Author}}/{{.Series}}; a / separates directories and each is sanitized on its own")
+	templateTest := flag.Bool("template-test", false, "print the name --template (or the default naming) gives a sample book and exit")
+	templateFields := flag.Bool("template-fields", false, "list the fields available to --template and exit")
+	flag.BoolVar(&opts.inPlace, "in-place", false, "rename files within their own directory instead of copying them to an output directory")
+	flag.StringVar(&opts.resolver.policy, "on-conflict", conflictOverwrite, "what to do when the output file already exists: overwrite, skip, suffix, warn-keep-source-dir, which adds the source's directory name, or hash, which adds a short hash of its contents (default suffix with --in-place)")
+	reportFormat := flag.String("report", "", "print a machine readable report instead of the per-file lines: json or csv")
+	summaryFile := flag.String("summary-file", "", "also write the totals and per-file results of the run to this file as JSON, whatever --report is")
+	flag.StringVar(&opts.resolver.suffix, "collision-suffix", suffixNumber, "with --on-conflict suffix, disambiguate with this field before falling back to numbers: number, year, isbn or uid")
+	flag.BoolVar(&opts.resolver.foldCase, "ci-fs", false, "treat output names differing only in case as conflicts (detected automatically for the output directory)")
+	onlyFailed := flag.String("only-failed", "", "process the files a previous --report json run failed on, read from this report")
+	mapFile := flag.String("map", "", "read tab separated <source> <target name> lines, or the planned entries of a --dry-run --report json, from this file (- for stdin) instead of naming files from their metadata")
+	flag.BoolVar(&opts.sanitizer.unicode, "unicode", false, "keep non-ASCII letters and digits in output names")
+	flag.StringVar(&opts.sanitizer.separator, "separator", "-", "text between the title and author of the default name, and between words with --minimal-sanitize; may be empty")
+	caseStyle := flag.String("case-style", caseNone, "recase the title, author and series before naming: none, lower, upper or title")
+	smallWords := flag.String("small-words", defaultSmallWords, "with --case-style title, the comma separated words kept lower case unless first, last or after a colon")
+	flag.BoolVar(&opts.sanitizer.keepSpaces, "keep-spaces", false, "with --unicode or --minimal-sanitize, separate words with single spaces instead of underscores or the --separator")
+	flag.BoolVar(&opts.sanitizer.collapseSame, "collapse-same", false, "name a book just Title.epub when its author is the same as its title")
+	flag.BoolVar(&opts.sanitizer.minimal, "minimal-sanitize", false, "only strip the --illegal-chars, control characters and path separators from names and replace whitespace with the --separator, keeping all other punctuation and Unicode letters")
+	flag.StringVar(&opts.sanitizer.illegal, "illegal-chars", defaultIllegalChars, "with --minimal-sanitize, the characters stripped from names")
+	flag.BoolVar(&opts.sanitizer.canonical, "canonical", false, "replace typographic punctuation (curly quotes, dashes, ellipses) with ASCII before sanitizing names")
+	flag.StringVar(&opts.sanitizer.normalize, "normalize", normalizeNFC, "Unicode normalization applied to output names: nfc, nfd or none")
+	recursive := flag.Bool("recursive", false, "process the .epub files found in directory arguments and their subdirectories")
+	flag.Var(&opts.inputExts, "input-ext", "with --recursive or --watch, pick up files with this extension, e.g. .kepub.epub; may be repeated (default .epub)")
+	followSymlinks := flag.Bool("follow-symlinks", false, "resolve symlinked inputs to their targets and, with --recursive, descend into symlinked directories; each directory is walked once, so link cycles are harmless")
+	watchDirectory := flag.String("watch", "", "keep running and process .epub files as they appear in this directory")
+	watchDelay := flag.Duration("watch-delay", 2*time.Second, "with --watch, how long a file must go unchanged before it is processed")
+	groupReport := flag.String("group-report", "", "after the summary, count processed books by a metadata field, e.g. by=author or by=series")
+	flag.StringVar(&opts.setTitle, "set-title", "", "use this title instead of the one in the metadata (single input file only)")
+	flag.StringVar(&opts.setAuthor, "set-author", "", "use this author instead of the one in the metadata (single input file only)")
+	flag.BoolVar(&opts.sortTitle, "sort-title", false, "use the sort title (e.g. \"Hobbit, The\") in place of the title when naming files")
+	flag.DurationVar(&opts.downloadTimeout, "timeout", time.Minute, "how long to wait for an http(s) input to download")
+	validate := flag.Bool("validate", false, "check that the files are structurally valid epubs instead of renaming them")
+	flag.StringVar(&opts.placeholders.title, "unknown-title", "Unknown", "title used when a book has none")
+	flag.StringVar(&opts.placeholders.author, "unknown-author", "Unknown", "author used when a book has none")
+	flag.StringVar(&opts.placeholders.series, "unknown-series", "Unknown", "series used when a book has none, through the unknown template function")
+	execCommand := flag.String("exec", "", "run this command after each successful file; {source}, {target} and metadata fields such as {title} are replaced")
+	execJobs := flag.Int("exec-jobs", 4, "how many --exec commands may run at once")
+	flag.StringVar(&opts.metadata.titleLang, "title-lang", "", "prefer the title in this language (e.g. en) when a book has several")
+	flag.IntVar(&opts.minChapters, "min-chapters", 0, "skip epubs with fewer than this many items in their reading order (spine); formats without one (MOBI, DOCX, ODT) are never skipped")
+	flag.BoolVar(&opts.failuresOnly, "report-failures-only", false, "only print a line for failed and skipped files (add --quiet-skips for failures alone); the summary still counts everything")
+	flag.BoolVar(&opts.quietSkips, "quiet-skips", false, "don't print a line for skipped files; they are still counted in the summary")
+	quiet := flag.Bool("quiet", false, "don't print a line per file, only the summary")
+	order := flag.String("order", orderStream, "when to print the per-file lines and --report entries: stream (as files finish) or sorted (by path, once all are done, which keeps every result in memory)")
+	flag.IntVar(&opts.workers, "jobs", runtime.NumCPU(), "how many files are processed at once (0 means all of them); this also bounds memory on very large batches")
+	maxErrors := flag.Int("max-errors", 0, "abort the remaining files once this many have failed (0 means never)")
+	limit := flag.Int("limit", 0, "only process the first N input files (0 means no limit)")
+	previewCount := flag.Bool("preview-count", false, "before reading any metadata, print how many inputs are left after --input-ext, --limit and duplicate removal")
+	countOnly := flag.Bool("count-only", false, "like --preview-count, but exit after printing the count")
+	output := flag.String("output", "", "the output directory, in place of the first argument; every argument is then an input")
+	flag.StringVar(output, "o", "", "shorthand for --output")
+	reorganize := flag.Bool("reorganize", false, "rename and move the books under a library directory to their current names within it, leaving those already named so alone (implies --recursive and --move; default --on-conflict suffix)")
+	flag.BoolVar(&opts.move, "move", false, "remove each input once it has been written to the output directory")
+	flag.BoolVar(&opts.symlink, "symlink", false, "create symlinks to the inputs in the output directory instead of copying them")
+	flag.BoolVar(&opts.linkRelative, "link-relative", false, "with --symlink, make the links relative to the output directory so it can be moved along with the originals")
+	flag.BoolVar(&opts.nativeDetect, "native-detect", false, "detect epubs from their zip structure alone (a leading, uncompressed mimetype entry and META-INF/container.xml) instead of sniffing the content; other formats and non-conforming epubs are rejected")
+	flag.BoolVar(&opts.writeOPF, "write-opf", false, "write a Calibre compatible OPF with the book's metadata next to each output file, under the same name")
+	flag.BoolVar(&opts.verify, "verify", false, "compare the checksum of every written file with its source; with --move, the source is only removed once its copy checks out")
+	flag.BoolVar(&opts.keepSourceOnVerifyFail, "keep-source-on-verify-fail", true, "with --move and --verify, keep the source and remove the bad copy when verification fails; false removes the source anyway")
+	flag.BoolVar(&opts.dryRun, "dry-run", false, "print where each file would go without writing anything")
+	ioConcurrency := flag.Int("io-concurrency", 0, "how many files may be copied to the output directory at once (0 means no limit); metadata is still read in parallel")
+	anthologyRoles := flag.String("anthology-roles", roleEditor, fmt.Sprintf("comma separated creator roles (MARC relator codes such as edt or aut), in order of preference, whose creator is .Author in books with %d or more creators; empty to always use the first listed creator", anthologyCreators))
+	suspiciousTitles := flag.String("suspicious-titles", defaultSuspiciousTitles, "comma separated placeholder titles to warn about; titles that look like file names (content.opf) always are")
+	flag.BoolVar(&opts.metadata.suspiciousFallback, "suspicious-title-fallback", false, "pass over placeholder titles for the book's next title, then the table of contents' title, then --unknown-title")
+	flag.StringVar(&opts.metadata.rendition, "rendition", "", "in books with several renditions, read this one: a 1-based index or a media type (default the first OPF)")
+	debug := flag.Bool("debug", false, "log details such as which OPF of each book was read")
+	listOPF := flag.Bool("list-opf-path", false, "print which OPF inside each input would be read, and whether container.xml or a scan for .opf entries found it, then exit")
+	printName := flag.Bool("print-name", false, "print the output file name computed for a single input file and exit without copying it")
+	diff := flag.Bool("diff", false, "instead of the per-file lines, list the targets that would be new (+) or overwritten (~) and the books in the output directory no input would produce (-); implies --dry-run")
+	explain := flag.Bool("explain", false, "show each metadata field before and after sanitizing, along with the resulting name; implies --dry-run")
+	yes := flag.Bool("yes", false, "don't ask for confirmation before a run that moves files or overwrites existing ones; it is only asked when stdin is a terminal")
+	fromArchive := flag.Bool("from-archive", false, "treat the input files as .zip, .tar, .tar.gz or .tgz bundles and process the .epub files inside them")
+	findDups := flag.String("find-duplicates", "", "list groups of inputs that look like the same book instead of renaming them, keyed by isbn, title+author or content-hash")
+	skipKnown := flag.String("skip-known", "", "skip inputs whose ISBN or UID is listed in this file, one per line (the first tab or comma separated field is used)")
+	replaceExisting := flag.Bool("replace-existing-only", false, "only write books that already have a copy in the output directory, matched by ISBN or title and author, replacing that copy; other inputs are skipped")
+	historyFile := flag.String("history", "", "append a timestamped JSON line per processed file to this file, which is kept across runs")
+	flag.Usage = usage
+	flag.Parse()
+
+	if *explain || *diff {
+		opts.dryRun = true
 	}
 
-	outputDirectory := os.Args[1]
-	isDir, err := isDirectory(outputDirectory)
-	if err != nil {
-		log.Print(err.Error())
-		os.Exit(1)
-	} else if !isDir {
-		log.Print(os.Args[1] + " is not a directory!")
-		os.Exit(1)
+	if *debug {
+		debugLog.SetOutput(os.Stderr)
+	}
+
+	if len(opts.inputExts) == 0 {
+		opts.inputExts = defaultExtensions
+	}
+
+	if *reorganize {
+		if opts.inPlace || opts.symlink || *mapFile != "" || *watchDirectory != "" || *fromArchive {
+			log.Print("--reorganize can't be combined with --in-place, --symlink, --map, --watch or --from-archive")
+			os.Exit(exitUsage)
+		}
+		// the library is both the input and the output
+		opts.move = true
+		*recursive = true
+	}
+
+	if (opts.inPlace || *reorganize) && !isFlagSet("on-conflict") {
+		// overwriting in place would silently delete one of the inputs
+		opts.resolver.policy = conflictSuffix
+	}
+
+	if *templateFields {
+		printTemplateFields(os.Stdout)
+		return
+	}
+
+	if strings.TrimSpace(*execCommand) != "" {
+		opts.hook = newHook(*execCommand, *execJobs)
+	}
+
+	if !validConflictPolicy(opts.resolver.policy) {
+		log.Print("unknown --on-conflict policy: " + opts.resolver.policy)
+		os.Exit(exitUsage)
+	}
+
+	if !validCollisionSuffix(opts.resolver.suffix) {
+		log.Print("unknown --collision-suffix: " + opts.resolver.suffix)
+		os.Exit(exitUsage)
+	}
+
+	if !validNormalization(opts.sanitizer.normalize) {
+		log.Print("unknown --normalize form: " + opts.sanitizer.normalize)
+		os.Exit(exitUsage)
+	}
+
+	if !validCaseStyle(*caseStyle) {
+		log.Print("unknown --case-style: " + *caseStyle)
+		os.Exit(exitUsage)
+	}
+	opts.caser = newCaser(*caseStyle, *smallWords)
+	opts.metadata.setSuspiciousTitles(*suspiciousTitles)
+	opts.metadata.setAnthologyRoles(*anthologyRoles)
+
+	if opts.sanitizer.keepSpaces && !opts.sanitizer.unicode && !opts.sanitizer.minimal {
+		log.Print("--keep-spaces needs --unicode or --minimal-sanitize")
+		os.Exit(exitUsage)
+	}
+
+	if !validSeparator(opts.sanitizer.separator) {
+		log.Print("--separator can't contain path separators or control characters")
+		os.Exit(exitUsage)
+	} else if opts.sanitizer.minimal && strings.ContainsAny(opts.sanitizer.separator, opts.sanitizer.illegal) {
+		// minimal sanitizing puts the separator between words too, after
+		// the illegal characters are stripped
+		log.Print("--separator can't contain any of the --illegal-chars with --minimal-sanitize")
+		os.Exit(exitUsage)
+	}
+
+	if *order != orderStream && *order != orderSorted {
+		log.Print("unknown --order: " + *order)
+		os.Exit(exitUsage)
+	}
+
+	if !validReportFormat(*reportFormat) {
+		log.Print("unknown --report format: " + *reportFormat)
+		os.Exit(exitUsage)
+	}
+
+	groupField := -1
+	if *groupReport != "" {
+		var ok bool
+		groupField, ok = bookDataField(strings.TrimPrefix(*groupReport, "by="))
+		if !ok {
+			log.Print("unknown --group-report field: " + *groupReport)
+			os.Exit(exitUsage)
+		}
+	}
+
+	if *findDups != "" && !validDuplicateKey(*findDups) {
+		log.Print("unknown --find-duplicates key: " + *findDups)
+		os.Exit(exitUsage)
+	}
+
+	if *skipKnown != "" {
+		var err error
+		if opts.known, err = readKnownIDs(*skipKnown); err != nil {
+			log.Print("--skip-known: " + err.Error())
+			os.Exit(exitUsage)
+		}
+	}
+
+	if *ioConcurrency > 0 {
+		opts.ioSlots = make(chan struct{}, *ioConcurrency)
+	}
+
+	if *historyFile != "" {
+		h, err := newHistory(*historyFile)
+		if err != nil {
+			log.Print("--history: " + err.Error())
+			os.Exit(exitUsage)
+		}
+		opts.history = h
+	}
+
+	args := flag.Args()
+	minArgs := 2
+	if opts.inPlace || *reorganize {
+		minArgs--
+	}
+	if *mapFile != "" || *onlyFailed != "" || *watchDirectory != "" || *validate || *printName || *listOPF || *findDups != "" {
+		// the inputs come from the map or report instead of the command line
+		minArgs--
+	}
+	if *templateTest {
+		minArgs = 0
+	}
+	needsOutput := !opts.inPlace && minArgs > 0 && !*validate && !*printName && !*listOPF && *findDups == ""
+	if needsOutput && *output != "" && (!*reorganize || len(args) == 0) {
+		args = append([]string{*output}, args...)
+	} else if env := os.Getenv(outputEnv); needsOutput && env != "" && len(args) == minArgs-1 {
+		// only the output directory is missing; an argument given for it
+		// always wins
+		args = append([]string{env}, args...)
+	}
+	if len(args) < minArgs {
+		if needsOutput && len(args) == minArgs-1 {
+			log.Print("no output directory given; pass it first, or with --output or " + outputEnv)
+		}
+		usage()
+		os.Exit(exitUsage)
+	}
+
+	if *templateText != "" && *nameTemplate != "" {
+		log.Print("--template and --name-template can't be combined")
+		os.Exit(exitUsage)
+	} else if *nameTemplate != "" {
+		*templateText = *nameTemplate
+	}
+
+	if *templateText != "" {
+		var err error
+		opts.template, err = parseTemplate(*templateText, &opts.placeholders)
+		if err != nil {
+			log.Print(err.Error())
+			os.Exit(exitUsage)
+		}
+	}
+
+	if *dirTemplate != "" {
+		var err error
+		opts.dirTemplate, err = parseTemplate(*dirTemplate, &opts.placeholders)
+		if err != nil {
+			log.Print("--dir-template: " + err.Error())
+			os.Exit(exitUsage)
+		}
+	}
+
+	if *templateTest {
+		book := sampleBook
+		opts.applyOverrides(&book)
+
+		filename, err := opts.filename(&book, ".epub")
+		if err != nil {
+			log.Print(err.Error())
+			os.Exit(exitUsage)
+		} else if filename == "" {
+			log.Print("the template renders an empty name")
+			os.Exit(exitUsage)
+		}
+
+		fmt.Println(filename)
+		return
+	}
+
+	if *printName {
+		if len(args) != 1 {
+			log.Print("--print-name takes exactly one input file")
+			os.Exit(exitUsage)
+		}
+
+		data, filename, err := nameBook(args[0], args[0], "", &opts)
+		if err != nil {
+			log.Print(err.Error())
+			os.Exit(exitAllFailed)
+		}
+		for _, warning := range opts.warnings(data) {
+			log.Print(args[0] + ": " + warning)
+		}
+
+		fmt.Println(filename)
+		return
+	}
+
+	if *validate {
+		files := expandInputs(args, *recursive, *followSymlinks, opts.inputExts)
+		os.Exit(exitCode(validateFiles(files), len(files)))
+	}
+
+	if *listOPF {
+		files := expandInputs(args, *recursive, *followSymlinks, opts.inputExts)
+		os.Exit(exitCode(listOPFPaths(os.Stdout, files, &opts.metadata), len(files)))
+	}
+
+	if *findDups != "" {
+		files := expandInputs(args, *recursive, *followSymlinks, opts.inputExts)
+		os.Exit(exitCode(findDuplicates(files, *findDups, &opts), len(files)))
+	}
+
+	if *reorganize {
+		if len(args) != 1 {
+			usage()
+			os.Exit(exitUsage)
+		}
+		args = append(args, args[0])
 	}
 
-	files := os.Args[2:]
-	results := map[string]bool{}
-	resultsChan := make(chan struct {
-		string
-		bool
+	files := args
+	if !opts.inPlace {
+		opts.outputDirectory = args[0]
+		isDir, err := isDirectory(opts.outputDirectory)
+		if err != nil {
+			log.Print(err.Error())
+			os.Exit(exitUsage)
+		} else if !isDir {
+			log.Print(opts.outputDirectory + " is not a directory!")
+			os.Exit(exitUsage)
+		}
+
+		files = args[1:]
+
+		// a dry run writes nothing, so it doesn't need to be able to
+		if !opts.dryRun {
+			if err := checkWritable(opts.outputDirectory); err != nil {
+				log.Print(opts.outputDirectory + " is not writable: " + err.Error())
+				os.Exit(exitUsage)
+			}
+		}
+
+		opts.resolver.fsFoldsCase, err = isCaseInsensitive(opts.outputDirectory, !opts.dryRun)
+		if err != nil {
+			log.Print(err.Error())
+			os.Exit(exitUsage)
+		}
+		opts.resolver.foldCase = opts.resolver.foldCase || opts.resolver.fsFoldsCase
+	}
+
+	if *diff && opts.inPlace {
+		log.Print("--diff needs an output directory")
+		os.Exit(exitUsage)
+	}
+
+	if opts.linkRelative && !opts.symlink {
+		log.Print("--link-relative needs --symlink")
+		os.Exit(exitUsage)
+	}
+
+	if opts.symlink && (opts.move || opts.inPlace) {
+		log.Print("--symlink can't be combined with --move or --in-place")
+		os.Exit(exitUsage)
+	}
+
+	if opts.move && opts.inPlace {
+		log.Print("--move can't be combined with --in-place, which already moves files")
+		os.Exit(exitUsage)
+	}
+
+	if *fromArchive && (opts.inPlace || *watchDirectory != "") {
+		log.Print("--from-archive can't be combined with --in-place or --watch")
+		os.Exit(exitUsage)
+	}
+
+	if *replaceExisting {
+		if opts.inPlace {
+			log.Print("--replace-existing-only needs an output directory")
+			os.Exit(exitUsage)
+		}
+
+		var err error
+		if opts.existing, err = indexOutput(opts.outputDirectory, &opts); err != nil {
+			log.Print(err.Error())
+			os.Exit(exitUsage)
+		}
+	}
+
+	if *watchDirectory != "" {
+		var report resultWriter
+		if *reportFormat != "" {
+			var err error
+			if report, err = newReportWriter(os.Stdout, *reportFormat); err != nil {
+				log.Print(err.Error())
+				os.Exit(exitSomeFailed)
+			}
+		}
+
+		// an interrupt ends the watch cleanly, so that a JSON report is
+		// still closed
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		err := watch(ctx, *watchDirectory, *watchDelay, &opts, func(result *Result) {
+			if report != nil {
+				if err := report.write(result); err != nil {
+					log.Print(err.Error())
+				}
+			} else if !*quiet && opts.shows(result) {
+				printResult(result)
+			}
+		})
+		if report != nil {
+			if closeErr := report.close(); closeErr != nil {
+				log.Print(closeErr.Error())
+			}
+		}
+		if err != nil {
+			log.Print(err.Error())
+			os.Exit(exitUsage)
+		}
+		return
+	}
+
+	files = expandInputs(files, *recursive, *followSymlinks, opts.inputExts)
+
+	var jobs []job
+	if *mapFile != "" {
+		var err error
+		jobs, err = readMapFile(*mapFile, opts.outputDirectory)
+		if err != nil {
+			log.Print(err.Error())
+			os.Exit(exitUsage)
+		}
+	}
+	missing := 0
+	if *onlyFailed != "" {
+		sources, gone, err := readFailedReport(*onlyFailed)
+		if err != nil {
+			log.Print(err.Error())
+			os.Exit(exitUsage)
+		}
+		for _, source := range gone {
+			log.Print(source + ": missing, no longer exists")
+		}
+		missing = len(gone)
+		files = append(files, sources...)
+	}
+
+	if *fromArchive {
+		extracted, err := extractArchives(files)
+		if err != nil {
+			log.Print(err.Error())
+			os.Exit(exitUsage)
+		}
+		jobs = append(jobs, extracted...)
+	} else {
+		for _, file := range files {
+			jobs = append(jobs, job{file: file})
+		}
+	}
+
+	for _, j := range markDuplicates(jobs) {
+		log.Print(j.file + ": skipped, duplicate of " + j.duplicateOf)
+	}
+
+	if *limit > 0 {
+		limited := limitJobs(jobs, *limit)
+		removeExtracted(jobs[len(limited):])
+		jobs = limited
+	}
+
+	if (opts.setTitle != "" || opts.setAuthor != "") && len(jobs) != 1 {
+		removeExtracted(jobs)
+		log.Print("--set-title and --set-author need exactly one input file; use --map to name several files by hand")
+		os.Exit(exitUsage)
+	}
+
+	if *previewCount || *countOnly {
+		// only the filters that don't need the metadata have been applied
+		count := 0
+		for _, j := range jobs {
+			if j.duplicateOf == "" {
+				count++
+			}
+		}
+
+		if *countOnly {
+			removeExtracted(jobs)
+			fmt.Printf("%d files will be processed\n", count)
+			return
+		}
+		fmt.Fprintf(os.Stderr, "%d files will be processed\n", count)
+	}
+
+	// overwrite is the default policy, so a plain run that would replace
+	// files asks first too. There is no one to ask without a terminal, or
+	// once --map - has read stdin.
+	if !opts.dryRun && !*yes && (opts.move || opts.resolver.policy == conflictOverwrite) && *mapFile != "-" && isTerminal(os.Stdin) {
+		results, unplanned := planRun(jobs, &opts)
+		moves, overwrites := planSummary(results, &opts)
+		if (moves > 0 || overwrites > 0) && !confirm(moves, overwrites, unplanned) {
+			removeExtracted(jobs)
+			log.Print("aborted, nothing was changed")
+			os.Exit(exitDeclined)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	resultsChan := make(chan Result)
+	go forEach(len(jobs), opts.workers, func(i int) {
+		run(ctx, jobs[i], &opts, resultsChan)
 	})
 
-	for _, file := range files {
-		go run(file, outputDirectory, resultsChan)
+	// results are streamed to the outputs as they arrive; only --order
+	// sorted has to hold on to them
+	var report resultWriter
+	if *reportFormat != "" {
+		var err error
+		if report, err = newReportWriter(os.Stdout, *reportFormat); err != nil {
+			log.Print(err.Error())
+			os.Exit(exitSomeFailed)
+		}
 	}
+	var summary *summaryWriter
+	if *summaryFile != "" {
+		var err error
+		if summary, err = newSummaryWriter(*summaryFile); err != nil {
+			log.Print("--summary-file: " + err.Error())
+			os.Exit(exitUsage)
+		}
+	}
+	var groups *groupCounts
+	if groupField >= 0 {
+		groups = newGroupCounts(groupField)
+	}
+	var diffs *outputDiff
+	if *diff {
+		diffs = newOutputDiff()
+	}
+
+	outputErr := false
+	emit := func(result *Result) {
+		if report != nil {
+			if err := report.write(result); err != nil && !outputErr {
+				outputErr = true
+				log.Print(err.Error())
+			}
+		} else if diffs == nil && !*quiet && opts.shows(result) {
+			if *explain {
+				printExplanation(os.Stdout, result, &opts)
+			}
+			printResult(result)
+		}
 
-	for i := 0; i < len(files); i++ {
+		if summary != nil {
+			if err := summary.write(result); err != nil && !outputErr {
+				outputErr = true
+				log.Print("--summary-file: " + err.Error())
+			}
+		}
+	}
+
+	var t tally
+	var sorted []Result
+	for i := 0; i < len(jobs); i++ {
 		result := <-resultsChan
-		results[result.string] = result.bool
+		t.add(&result, &opts)
+		if groups != nil {
+			groups.add(&result)
+		}
+		if diffs != nil {
+			diffs.add(&result, &opts.resolver)
+		}
+
+		if *order == orderSorted {
+			sorted = append(sorted, result)
+		} else {
+			emit(&result)
+		}
+
+		if errors.Is(result.Err, errOutputGone) && ctx.Err() == nil {
+			log.Print(opts.outputDirectory + " disappeared, aborting the run")
+			cancel()
+		}
+
+		if result.Status == statusFailed && t.failed == *maxErrors {
+			log.Printf("aborted after %d errors", t.failed)
+			cancel()
+		}
+	}
+
+	for _, result := range resultList(sorted) {
+		emit(&result)
 	}
 
-	succeeded := 0
-	failed := 0
-	for file, result := range results {
-		if result {
-			succeeded += 1
-			color.Green("%s: ✅", file)
+	if report != nil {
+		if err := report.close(); err != nil {
+			log.Print(err.Error())
+			outputErr = true
+		}
+	} else {
+		if diffs != nil {
+			if err := diffs.print(os.Stdout, opts.outputDirectory, &opts); err != nil {
+				log.Print(err.Error())
+				outputErr = true
+			}
+		}
+		if opts.dryRun {
+			fmt.Println("planned:", t.planned)
+			fmt.Printf("would move %d files and overwrite %d existing files\n", t.moves, t.overwrites)
+			printEmptyNames(t.emptyNames)
 		} else {
-			failed += 1
-			color.Red("%s: ❌", file)
+			fmt.Println("succeeded:", t.succeeded)
+		}
+		fmt.Println("failed:", t.failed)
+		if t.skipped > 0 || opts.quietSkips {
+			// the skip lines weren't shown, so the total always is
+			fmt.Println("skipped:", t.skipped)
+		}
+		if missing > 0 {
+			fmt.Println("missing:", missing)
+		}
+		if t.hookFailures > 0 {
+			fmt.Println("hook failures:", t.hookFailures)
 		}
+		if t.warned > 0 {
+			fmt.Println("with warnings:", t.warned)
+		}
+
+		if groups != nil {
+			fmt.Println()
+			groups.print(os.Stdout)
+		}
+	}
+
+	if summary != nil {
+		if err := summary.finish(&t); err != nil {
+			log.Print("--summary-file: " + err.Error())
+			outputErr = true
+		}
+	}
+
+	code := exitCode(t.failed, t.total)
+	if outputErr && code == exitOK {
+		code = exitSomeFailed
+	}
+
+	os.Exit(code)
+}
+
+// resultList returns the results sorted by source path.
+func resultList(results []Result) []Result {
+	sorted := append([]Result(nil), results...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].File < sorted[j].File })
+
+	return sorted
+}
+
+// exitCode picks the exit status for a run in which failed out of total
+// files failed.
+func exitCode(failed int, total int) int {
+	switch {
+	case failed == 0:
+		return exitOK
+	case failed == total:
+		return exitAllFailed
 	}
 
-	fmt.Println("succeeded:", succeeded)
-	fmt.Println("failed:", failed)
+	return exitSomeFailed
 }
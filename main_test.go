@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A relative link keeps resolving when the directory holding both it and
+// its source is moved.
+func TestRelativeLinkSurvivesRename(t *testing.T) {
+	root := t.TempDir()
+	library := filepath.Join(root, "library")
+	source := filepath.Join(library, "incoming", "book.epub")
+	target := filepath.Join(library, "sorted", "Author", "Title.epub")
+	for _, dir := range []string{filepath.Dir(source), filepath.Dir(target)} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(source, []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := linkFile(source, target, true); err != nil {
+		t.Fatal(err)
+	}
+	if link, err := os.Readlink(target); err != nil || filepath.IsAbs(link) {
+		t.Fatalf("got link %q (%v), want a relative path", link, err)
+	}
+
+	moved := filepath.Join(root, "moved")
+	if err := os.Rename(library, moved); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(moved, "sorted", "Author", "Title.epub"))
+	if err != nil || string(content) != "contents" {
+		t.Fatalf("got %q (%v) through the moved link, want the source contents", content, err)
+	}
+}
+
+// A panicking parser fails its own file; the rest of the batch still gets
+// its results.
+func TestPanicFailsOnlyItsFile(t *testing.T) {
+	defer func(reader func(string, string, *options) (BookData, string, error)) {
+		bookReader = reader
+	}(bookReader)
+	bookReader = func(file string, path string, opts *options) (BookData, string, error) {
+		if strings.HasPrefix(filepath.Base(file), "bad") {
+			panic("malformed " + file)
+		}
+		return BookData{Title: strings.TrimSuffix(filepath.Base(file), ".epub"), Author: "Author"}, ".epub", nil
+	}
+
+	opts := options{outputDirectory: t.TempDir(), dryRun: true, workers: 2}
+	jobs := []job{{file: "a.epub"}, {file: "bad.epub"}, {file: "b.epub"}, {file: "bad2.epub"}, {file: "c.epub"}}
+
+	results := make([]Result, len(jobs))
+	forEach(len(jobs), opts.workers, func(i int) {
+		results[i] = jobs[i].process(context.Background(), &opts)
+	})
+
+	for i, res := range results {
+		bad := strings.HasPrefix(jobs[i].file, "bad")
+		switch {
+		case bad && (res.Status != statusFailed || res.Err == nil || !strings.Contains(res.Err.Error(), "internal error")):
+			t.Errorf("%s: got %v (%v), want an internal error", jobs[i].file, res.Status, res.Err)
+		case !bad && res.Status != statusPlanned:
+			t.Errorf("%s: got %v (%v), want it planned", jobs[i].file, res.Status, res.Err)
+		}
+	}
+}
+
+// slowDisk simulates a spinning disk: one write at a time, each chunk
+// taking chunkTime, plus seekTime whenever it switches to another file.
+type slowDisk struct {
+	mu        sync.Mutex
+	last      io.Writer
+	seekTime  time.Duration
+	chunkTime time.Duration
+}
+
+func (d *slowDisk) copy(dst io.Writer, src io.Reader) (int64, error) {
+	buf := make([]byte, 32<<10)
+	var written int64
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			d.mu.Lock()
+			if d.last != dst {
+				time.Sleep(d.seekTime)
+				d.last = dst
+			}
+			time.Sleep(d.chunkTime)
+			d.mu.Unlock()
+
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return written, err
+			}
+			written += int64(n)
+		}
+		if err == io.EOF {
+			return written, nil
+		} else if err != nil {
+			return written, err
+		}
+	}
+}
+
+// BenchmarkPlace copies a batch of files to a simulated slow disk with
+// every worker writing at once, and with --io-concurrency bounding the
+// writers so that the disk seeks less.
+func BenchmarkPlace(b *testing.B) {
+	defer func(original func(io.Writer, io.Reader) (int64, error)) { copyData = original }(copyData)
+	disk := &slowDisk{seekTime: time.Millisecond, chunkTime: 100 * time.Microsecond}
+	copyData = disk.copy
+
+	const files = 16
+	source := filepath.Join(b.TempDir(), "book.epub")
+	if err := os.WriteFile(source, make([]byte, 256<<10), 0644); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, slots := range []int{0, 1, 2, 4} {
+		name := "unbounded"
+		if slots > 0 {
+			name = "io-concurrency=" + strconv.Itoa(slots)
+		}
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				opts := options{outputDirectory: b.TempDir(), workers: files}
+				if slots > 0 {
+					opts.ioSlots = make(chan struct{}, slots)
+				}
+				results := make([]Result, files)
+				for j := range results {
+					results[j] = Result{File: source, path: source}
+				}
+				b.StartTimer()
+
+				forEach(files, opts.workers, func(j int) {
+					place(context.Background(), &results[j], fmt.Sprintf("Book %d.epub", j), &opts)
+				})
+
+				for _, res := range results {
+					if res.Status != statusSucceeded {
+						b.Fatalf("got %v (%v), want the copy to succeed", res.Status, res.Err)
+					}
+				}
+			}
+		})
+	}
+}
+
+// --min-chapters only holds back books whose format counts chapters.
+func TestMinChaptersSkipsOnlyCountedBooks(t *testing.T) {
+	defer func(reader func(string, string, *options) (BookData, string, error)) {
+		bookReader = reader
+	}(bookReader)
+	chapters := map[string]int{"pamphlet.epub": 1, "novel.epub": 30, "notes.docx": 0}
+	bookReader = func(file string, path string, opts *options) (BookData, string, error) {
+		return BookData{Title: file, Author: "Author", ChapterCount: chapters[file]}, filepath.Ext(file), nil
+	}
+
+	opts := options{outputDirectory: t.TempDir(), dryRun: true, minChapters: 3}
+	for file, want := range map[string]status{"pamphlet.epub": statusSkipped, "novel.epub": statusPlanned, "notes.docx": statusPlanned} {
+		if res := process(context.Background(), file, file, &opts); res.Status != want {
+			t.Errorf("%s: got %v (%v), want %v", file, res.Status, res.Err, want)
+		}
+	}
+}
+
+// With {{.Hash}} in the template, the hash is taken from the copy into the
+// output directory rather than from a read of its own, and the copy is
+// renamed into place.
+func TestHashFromCopy(t *testing.T) {
+	defer func(original func(io.Writer, io.Reader) (int64, error)) { copyData = original }(copyData)
+	var copies int32
+	copyData = func(dst io.Writer, src io.Reader) (int64, error) {
+		atomic.AddInt32(&copies, 1)
+		return io.Copy(dst, src)
+	}
+
+	dir := t.TempDir()
+	source := writeEpub(t, dir, "book.epub", epubEntries("content.opf", testOPF("Dune", "Frank Herbert", "")))
+	want, err := fileHash(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := options{outputDirectory: t.TempDir(), verify: true}
+	if opts.template, err = parseTemplate("{{.Title}}-{{.Hash}}", &opts.placeholders); err != nil {
+		t.Fatal(err)
+	}
+
+	res := process(context.Background(), source, source, &opts)
+	if res.Status != statusSucceeded || filepath.Base(res.Target) != "Dune-"+want+".epub" {
+		t.Fatalf("got %v (%v) to %s, want it copied to Dune-%s.epub", res.Status, res.Err, res.Target, want)
+	}
+	if copies != 1 {
+		t.Errorf("the book was copied %d times, want once", copies)
+	}
+	if entries, _ := os.ReadDir(opts.outputDirectory); len(entries) != 1 {
+		t.Errorf("%d files in the output directory, want only the book", len(entries))
+	}
+}
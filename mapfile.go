@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// readMapFile reads the tab separated source/target pairs given to --map.
+// Blank lines are ignored; path is read from stdin when it is "-". A
+// --report json written by a --dry-run into outputDirectory is taken as well,
+// so that a reviewed plan can be applied as it is.
+func readMapFile(path string, outputDirectory string) ([]job, error) {
+	var r io.Reader = os.Stdin
+	name := "stdin"
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		r = f
+		name = path
+	}
+
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(content), []byte("[")) {
+		return readPlan(name, content, outputDirectory)
+	}
+
+	var jobs []job
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+
+		fields := strings.Split(text, "\t")
+		if len(fields) != 2 || fields[0] == "" || fields[1] == "" {
+			return nil, fmt.Errorf("%s:%d: expected <source>\\t<target>", name, line)
+		}
+
+		jobs = append(jobs, job{file: fields[0], filename: fields[1]})
+	}
+
+	return jobs, scanner.Err()
+}
+
+// readPlan turns the planned entries of a dry run's JSON report into jobs.
+// Their targets must be beneath outputDirectory, whether either is given as
+// an absolute or a relative path, and keep the subdirectories the plan put
+// them in.
+func readPlan(name string, content []byte, outputDirectory string) ([]job, error) {
+	var entries []reportEntry
+	if err := json.Unmarshal(content, &entries); err != nil {
+		return nil, errors.New(name + ": " + err.Error())
+	}
+
+	dir, err := filepath.Abs(outputDirectory)
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []job
+	for _, entry := range entries {
+		if entry.Status != statusPlanned.String() {
+			continue
+		}
+		target, err := filepath.Abs(entry.Target)
+		if err != nil {
+			return nil, errors.New(name + ": " + err.Error())
+		}
+		if !withinDirectory(dir, target) {
+			return nil, fmt.Errorf("%s: target %s of %s is not in %s", name, entry.Target, entry.Source, outputDirectory)
+		}
+
+		rel, err := filepath.Rel(dir, target)
+		if err != nil {
+			return nil, errors.New(name + ": " + err.Error())
+		}
+		jobs = append(jobs, job{file: entry.Source, filename: rel, nested: true})
+	}
+
+	return jobs, nil
+}
+
+// validateMappedName rejects --map targets that aren't a plain file name, so
+// a map can't write outside of the output directory.
+func validateMappedName(name string) error {
+	if name == "." || name == ".." || filepath.Base(name) != name || strings.ContainsAny(name, `/\`) {
+		return errors.New("target " + name + " must be a file name, not a path")
+	}
+
+	return nil
+}
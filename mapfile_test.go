@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// planContent is a dry run's JSON report planning source to target.
+func planContent(t *testing.T, source string, target string) []byte {
+	t.Helper()
+
+	content, err := json.Marshal([]reportEntry{
+		{Source: source, Target: target, Status: statusPlanned.String()},
+		{Source: "failed.epub", Status: statusFailed.String()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return content
+}
+
+// A plan applies to the output directory it was made for however either
+// path is spelled, keeping the subdirectories of its targets.
+func TestReadPlan(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	abs := t.TempDir()
+	rel, err := filepath.Rel(wd, abs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name   string
+		target string
+		output string
+		want   string
+	}{
+		{"absolute", filepath.Join(abs, "Title-Author.epub"), abs, "Title-Author.epub"},
+		{"absolute plan, relative output", filepath.Join(abs, "Title-Author.epub"), rel, "Title-Author.epub"},
+		{"relative plan, absolute output", filepath.Join(rel, "Title-Author.epub"), abs, "Title-Author.epub"},
+		{"subdirectories", filepath.Join(abs, "Author", "Series", "Title.epub"), abs + string(filepath.Separator), filepath.Join("Author", "Series", "Title.epub")},
+	} {
+		jobs, err := readPlan("plan.json", planContent(t, "book.epub", test.target), test.output)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if len(jobs) != 1 || jobs[0].file != "book.epub" || jobs[0].filename != test.want || !jobs[0].nested {
+			t.Errorf("%s: got %+v, want book.epub planned as %s", test.name, jobs, test.want)
+		}
+	}
+
+	for _, target := range []string{filepath.Join(abs, "..", "Title.epub"), abs, filepath.Join(wd, "Title.epub")} {
+		if _, err := readPlan("plan.json", planContent(t, "book.epub", target), abs); err == nil {
+			t.Errorf("target %s outside of %s accepted", target, abs)
+		}
+	}
+}
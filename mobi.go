@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/net/html/charset"
+)
+
+const mobiMimetype = "application/x-mobipocket-ebook"
+
+// the EXTH record types read into BookData
+const (
+	exthAuthor    = 100
+	exthPublisher = 101
+	exthISBN      = 104
+	exthDate      = 106
+	exthRights    = 109
+	exthTitle     = 503
+	exthLanguage  = 524
+)
+
+// mobiExts are the extensions Kindle books go by. Which one a book had is
+// kept, as the MOBI header alone can't tell an .azw from a .mobi.
+var mobiExts = map[string]bool{".mobi": true, ".azw": true, ".azw3": true, ".prc": true}
+
+// readMobiData reads the metadata of the MOBI or AZW3 book at path from the
+// EXTH header of its first record, returning the extension it should keep.
+func readMobiData(file string, path string) (BookData, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return BookData{}, "", err
+	}
+	defer f.Close()
+
+	record, err := mobiFirstRecord(f)
+	if err != nil {
+		return BookData{}, "", errors.New(file + ": " + err.Error())
+	}
+
+	// record 0 is a 16 byte PalmDOC header followed by the MOBI header
+	if len(record) < 132 || string(record[16:20]) != "MOBI" {
+		return BookData{}, "", errors.New(file + ": no MOBI header")
+	}
+	headerLength := int(binary.BigEndian.Uint32(record[20:]))
+	utf8 := binary.BigEndian.Uint32(record[28:]) == 65001
+	version := binary.BigEndian.Uint32(record[36:])
+
+	var data BookData
+	exth := map[uint32][]string{}
+	if binary.BigEndian.Uint32(record[128:])&0x40 != 0 && 16+headerLength < len(record) {
+		exth = readEXTH(record[16+headerLength:], utf8)
+	}
+
+	data.Title = first(exth[exthTitle])
+	if data.Title == "" {
+		offset := int(binary.BigEndian.Uint32(record[84:]))
+		length := int(binary.BigEndian.Uint32(record[88:]))
+		if offset >= 0 && length >= 0 && offset+length <= len(record) {
+			data.Title = strings.TrimSpace(mobiText(record[offset:offset+length], utf8))
+		}
+	}
+	data.TitleSort = sortTitle(data.Title)
+
+	for _, author := range exth[exthAuthor] {
+		if author = strings.TrimSpace(author); author != "" {
+			data.Authors = append(data.Authors, author)
+		}
+	}
+	data.Author = first(data.Authors)
+	data.Publisher = first(exth[exthPublisher])
+	data.Rights = first(exth[exthRights])
+	data.Language = first(exth[exthLanguage])
+	if date := first(exth[exthDate]); len(date) >= 4 && isDigits(date[:4]) {
+		data.Year = date[:4]
+	}
+	for _, value := range exth[exthISBN] {
+		id := opfIdentifier{Scheme: "isbn", Value: value}
+		if data.ISBN = id.isbn(); data.ISBN != "" {
+			break
+		}
+	}
+
+	ext := strings.ToLower(filepath.Ext(file))
+	if !mobiExts[ext] {
+		ext = ".mobi"
+		if version >= 8 {
+			ext = ".azw3"
+		}
+	}
+
+	return data, ext, nil
+}
+
+// mobiFirstRecord returns record 0 of the Palm database r, which holds the
+// MOBI and EXTH headers, without reading the text that follows it.
+func mobiFirstRecord(r io.ReaderAt) ([]byte, error) {
+	header := make([]byte, 78+16)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, errors.New("truncated Palm database header")
+	}
+	if string(header[60:68]) != "BOOKMOBI" {
+		return nil, errors.New("not a MOBI book")
+	}
+	if binary.BigEndian.Uint16(header[76:]) < 2 {
+		return nil, errors.New("no records")
+	}
+
+	start := int64(binary.BigEndian.Uint32(header[78:]))
+	end := int64(binary.BigEndian.Uint32(header[86:]))
+	if end <= start || end-start > 1<<20 {
+		return nil, errors.New("bad record 0 bounds")
+	}
+
+	record := make([]byte, end-start)
+	if _, err := r.ReadAt(record, start); err != nil {
+		return nil, errors.New("truncated record 0")
+	}
+
+	return record, nil
+}
+
+// readEXTH returns the values of the EXTH header at the start of b by type.
+func readEXTH(b []byte, utf8 bool) map[uint32][]string {
+	records := map[uint32][]string{}
+	if len(b) < 12 || string(b[:4]) != "EXTH" {
+		return records
+	}
+
+	count := binary.BigEndian.Uint32(b[8:])
+	b = b[12:]
+	for i := uint32(0); i < count && len(b) >= 8; i++ {
+		kind := binary.BigEndian.Uint32(b)
+		length := binary.BigEndian.Uint32(b[4:])
+		if length < 8 || int64(length) > int64(len(b)) {
+			break
+		}
+
+		records[kind] = append(records[kind], mobiText(b[8:length], utf8))
+		b = b[length:]
+	}
+
+	return records
+}
+
+// mobiText decodes a MOBI string, which is either UTF-8 or Windows-1252
+// depending on the header's text encoding.
+func mobiText(b []byte, utf8 bool) string {
+	if utf8 {
+		return string(b)
+	}
+
+	r, err := charset.NewReaderLabel("windows-1252", bytes.NewReader(b))
+	if err != nil {
+		return string(b)
+	}
+	decoded, err := io.ReadAll(r)
+	if err != nil {
+		return string(b)
+	}
+
+	return string(decoded)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"strings"
+
+	"golang.org/x/net/html/charset"
+)
+
+const ncxMediaType = "application/x-dtbncx+xml"
+
+type opfSpine struct {
+	// Toc is the manifest id of the EPUB 2 NCX
+	Toc      string       `xml:"toc,attr"`
+	Itemrefs []opfItemref `xml:"itemref"`
+}
+
+type opfItemref struct {
+	IDRef string `xml:"idref,attr"`
+}
+
+type ncxDocument struct {
+	DocTitle innerText `xml:"docTitle>text"`
+}
+
+type navDocument struct {
+	Title innerText `xml:"head>title"`
+}
+
+// navTitle is the last resort for books whose OPF has no title: the
+// docTitle of the EPUB 2 NCX, or the title of the EPUB 3 navigation
+// document, both of which tools tend to fill in from the book's title page.
+func navTitle(r *zip.Reader, opfPath string, pkg *opfPackage) string {
+	for _, item := range pkg.Manifest {
+		if item.MediaType != ncxMediaType && (pkg.Spine.Toc == "" || item.ID != pkg.Spine.Toc) {
+			continue
+		}
+
+		var ncx ncxDocument
+		if decodeZipXML(r, resolveHref(opfPath, item.Href), &ncx) {
+			if title := strings.TrimSpace(string(ncx.DocTitle)); title != "" {
+				return title
+			}
+		}
+	}
+
+	for _, item := range pkg.Manifest {
+		if !item.hasProperty("nav") {
+			continue
+		}
+
+		var nav navDocument
+		if decodeZipXML(r, resolveHref(opfPath, item.Href), &nav) {
+			if title := strings.TrimSpace(string(nav.Title)); title != "" {
+				return title
+			}
+		}
+	}
+
+	return ""
+}
+
+func (item *opfItem) hasProperty(property string) bool {
+	for _, p := range strings.Fields(item.Properties) {
+		if p == property {
+			return true
+		}
+	}
+
+	return false
+}
+
+// decodeZipXML decodes the zip entry name into v, reporting whether that
+// worked. Navigation documents are XHTML, so the decoder is lenient about
+// HTML entities and unclosed elements.
+func decodeZipXML(r *zip.Reader, name string, v interface{}) bool {
+	file := findZipFile(r, name)
+	if file == nil {
+		return false
+	}
+
+	rc, err := openEntry(file)
+	if err != nil {
+		return false
+	}
+	defer rc.Close()
+
+	decoder := xml.NewDecoder(rc)
+	decoder.CharsetReader = charset.NewReaderLabel
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+
+	return decoder.Decode(v) == nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"errors"
+	"strings"
+
+	"golang.org/x/net/html/charset"
+)
+
+// officeFormat is an office document format whose Dublin Core properties
+// can name a file in place of an OPF.
+type officeFormat struct {
+	ext string
+	// metaPath is the zip entry holding the document's properties
+	metaPath string
+	// marker is an entry only documents of this format have, for archives
+	// mimetype only recognised as zips
+	marker string
+}
+
+var (
+	docxFormat = &officeFormat{ext: ".docx", metaPath: "docProps/core.xml", marker: "word/document.xml"}
+	odtFormat  = &officeFormat{ext: ".odt", metaPath: "meta.xml", marker: "content.xml"}
+)
+
+// officeFormats maps the media types mimetype reports to their formats.
+var officeFormats = map[string]*officeFormat{
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document": docxFormat,
+	"application/vnd.oasis.opendocument.text":                                 odtFormat,
+}
+
+// detectOfficeFormat recognises office documents from their entries, for
+// the ones detected as plain zips.
+func detectOfficeFormat(r *zip.Reader) *officeFormat {
+	for _, format := range []*officeFormat{docxFormat, odtFormat} {
+		if findZipFile(r, format.metaPath) != nil && findZipFile(r, format.marker) != nil {
+			return format
+		}
+	}
+
+	return nil
+}
+
+// officeProperties are the Dublin Core elements of a DOCX core.xml, which
+// are the same as an OPF's apart from the dates. An ODT meta.xml has them one
+// element further down, in office:meta.
+type officeProperties struct {
+	opfMetadata
+	Created        []string    `xml:"created"`
+	CreationDate   []string    `xml:"creation-date"`
+	InitialCreator []innerText `xml:"initial-creator"`
+}
+
+type odtDocumentMeta struct {
+	Meta officeProperties `xml:"meta"`
+}
+
+// readOfficeData reads the document properties of an office document into
+// the same metadata as an OPF's, so naming works the same.
+func readOfficeData(r *zip.Reader, format *officeFormat, mopts *metadataOptions) (BookData, error) {
+	file := findZipFile(r, format.metaPath)
+	if file == nil {
+		return BookData{}, errors.New(format.metaPath + " is missing")
+	}
+
+	rc, err := openEntry(file)
+	if err != nil {
+		return BookData{}, err
+	}
+	defer rc.Close()
+
+	decoder := xml.NewDecoder(rc)
+	decoder.CharsetReader = charset.NewReaderLabel
+
+	var props officeProperties
+	if format == odtFormat {
+		var doc odtDocumentMeta
+		err = decoder.Decode(&doc)
+		props = doc.Meta
+	} else {
+		err = decoder.Decode(&props)
+	}
+	if err != nil {
+		return BookData{}, err
+	}
+
+	md := props.opfMetadata
+	md.Dates = append(append(md.Dates, props.Created...), props.CreationDate...)
+	if len(md.Creators) == 0 {
+		for _, creator := range props.InitialCreator {
+			md.Creators = append(md.Creators, opfCreator{Name: creator})
+		}
+	}
+	// Word keeps several authors in one dc:creator, separated by semicolons
+	var creators []opfCreator
+	for _, creator := range md.Creators {
+		for _, name := range strings.Split(string(creator.Name), ";") {
+			creators = append(creators, opfCreator{Name: innerText(strings.TrimSpace(name))})
+		}
+	}
+	md.Creators = creators
+
+	pkg := opfPackage{Metadata: md}
+	return pkg.bookData(mopts), nil
+}
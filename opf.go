@@ -0,0 +1,714 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html/charset"
+)
+
+// BookData is the metadata available to filename templates and reports. The
+// desc and example tags are shown by --template-fields.
+type BookData struct {
+	Title       string   `json:"title" desc:"the book's title" example:"The Great Gatsby"`
+	TitleSort   string   `json:"title_sort" desc:"the title as sorted, with leading articles moved to the end" example:"Great Gatsby, The"`
+	Author      string   `json:"author" desc:"the first listed creator, or in an anthology the first with an --anthology-roles role" example:"F. Scott Fitzgerald"`
+	Authors     []string `json:"authors" desc:"every listed creator" example:"[F. Scott Fitzgerald]"`
+	Editor      string   `json:"editor" desc:"the first creator with the editor (edt) role" example:"Maxwell Perkins"`
+	Series      string   `json:"series" desc:"the series the book belongs to" example:"Jazz Age"`
+	SeriesIndex string   `json:"series_index" desc:"the book's position in its series" example:"2"`
+	Year        string   `json:"year" desc:"the publication year" example:"1925"`
+	Modified    string   `json:"modified" desc:"when the EPUB 3 package was last modified (dcterms:modified), in ISO 8601" example:"2021-03-14T09:26:53Z"`
+	Language    string   `json:"language" desc:"the language code" example:"en"`
+	ISBN        string   `json:"isbn" desc:"the ISBN, without hyphens" example:"9780743273565"`
+	Publisher   string   `json:"publisher" desc:"the publisher" example:"Scribner"`
+	Rights      string   `json:"rights" desc:"the copyright statement" example:"Public domain"`
+	UID         string   `json:"uid" desc:"the package's unique identifier" example:"urn:uuid:0c1a5f3e-7e8d-4b1a-9d3c-2f6e8a9b1c4d"`
+	// ChapterCount is the length of the spine, which is as close to a
+	// chapter count as the OPF gets
+	ChapterCount int `json:"chapter_count" desc:"the number of items in the reading order (spine), 0 for formats without one" example:"9"`
+	// Meta holds every named <meta>, for custom fields without a field of
+	// their own
+	Meta map[string]string `json:"meta,omitempty" desc:"the OPF's <meta name content> pairs, e.g. {{index .Meta \"calibre:rating\"}}" example:"map[calibre:rating:8]"`
+	// Hash is only filled in when the template uses it
+	Hash string `json:"hash,omitempty" desc:"the first 8 hex digits of the file's SHA-256" example:"3f2a9c1b"`
+}
+
+type opfPackage struct {
+	// XMLName is the root element, which decodeOPF checks is a package
+	XMLName xml.Name
+	// UniqueIdentifier is the id of the identifier element naming the book
+	UniqueIdentifier string      `xml:"unique-identifier,attr"`
+	Metadata         opfMetadata `xml:"metadata"`
+	Manifest         []opfItem   `xml:"manifest>item"`
+	Spine            opfSpine    `xml:"spine"`
+}
+
+type opfItem struct {
+	ID        string `xml:"id,attr"`
+	Href      string `xml:"href,attr"`
+	MediaType string `xml:"media-type,attr"`
+	// Properties is a space separated list, e.g. "nav" for the EPUB 3
+	// navigation document
+	Properties string `xml:"properties,attr"`
+}
+
+// resolveHref turns an href from the OPF at opfPath into the name of a zip
+// entry. Hrefs are URLs relative to the OPF itself, so an OPF at
+// OEBPS/content.opf refers to OEBPS/images/cover.jpg as images/cover.jpg.
+func resolveHref(opfPath string, href string) string {
+	if i := strings.IndexAny(href, "#?"); i >= 0 {
+		href = href[:i]
+	}
+	if unescaped, err := url.PathUnescape(href); err == nil {
+		href = unescaped
+	}
+
+	return path.Join(path.Dir(opfPath), href)
+}
+
+type opfMetadata struct {
+	Titles      []opfTitle      `xml:"title"`
+	Creators    []opfCreator    `xml:"creator"`
+	Dates       []string        `xml:"date"`
+	Languages   []string        `xml:"language"`
+	Publishers  []innerText     `xml:"publisher"`
+	Rights      []innerText     `xml:"rights"`
+	Identifiers []opfIdentifier `xml:"identifier"`
+	Metas       []opfMeta       `xml:"meta"`
+}
+
+type opfIdentifier struct {
+	ID     string `xml:"id,attr"`
+	Scheme string `xml:"scheme,attr"`
+	Value  string `xml:",chardata"`
+}
+
+// opfMeta is either an EPUB 2 <meta name content/> or an EPUB 3
+// <meta property>value</meta>.
+type opfMeta struct {
+	Name     string `xml:"name,attr"`
+	Content  string `xml:"content,attr"`
+	Property string `xml:"property,attr"`
+	// ID and Refines tie EPUB 3 metas together, e.g. a group-position
+	// refining a belongs-to-collection
+	ID      string `xml:"id,attr"`
+	Refines string `xml:"refines,attr"`
+	Value   string `xml:",chardata"`
+}
+
+// innerText is the text content of an element including that of any nested
+// elements, with runs of whitespace collapsed. A plain string field would
+// only get the element's own character data, so a title such as
+// <dc:title>The <i>Great</i> Gatsby</dc:title> would lose its middle word.
+type innerText string
+
+func (t *innerText) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	text, err := readInnerText(d)
+	if err != nil {
+		return err
+	}
+
+	*t = innerText(text)
+	return nil
+}
+
+func readInnerText(d *xml.Decoder) (string, error) {
+	var sb strings.Builder
+	for depth := 1; depth > 0; {
+		token, err := d.Token()
+		if err != nil {
+			return "", err
+		}
+
+		switch token := token.(type) {
+		case xml.CharData:
+			sb.Write(token)
+		case xml.StartElement:
+			depth++
+		case xml.EndElement:
+			depth--
+		}
+	}
+
+	return strings.Join(strings.Fields(sb.String()), " "), nil
+}
+
+// opfTitle is a dc:title along with its xml:lang, as multilingual editions
+// list one title per language.
+type opfTitle struct {
+	Lang string
+	Text innerText
+}
+
+func (t *opfTitle) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	for _, attr := range start.Attr {
+		if attr.Name.Local == "lang" && (attr.Name.Space == "xml" || attr.Name.Space == xmlNamespace) {
+			t.Lang = attr.Value
+		}
+	}
+
+	text, err := readInnerText(d)
+	if err != nil {
+		return err
+	}
+
+	t.Text = innerText(text)
+	return nil
+}
+
+// opfCreator is a dc:creator along with its role, a MARC relator code such
+// as aut or edt. EPUB 2 puts the role in an opf:role attribute; EPUB 3
+// refines the creator's id with a role meta instead.
+type opfCreator struct {
+	ID   string
+	Role string
+	Name innerText
+}
+
+func (c *opfCreator) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	for _, attr := range start.Attr {
+		switch attr.Name.Local {
+		case "id":
+			c.ID = attr.Value
+		case "role":
+			c.Role = strings.ToLower(strings.TrimSpace(attr.Value))
+		}
+	}
+
+	text, err := readInnerText(d)
+	if err != nil {
+		return err
+	}
+
+	c.Name = innerText(text)
+	return nil
+}
+
+// anthologyCreators is how many creators make a book an anthology, whose
+// .Author is picked by role rather than by order.
+const anthologyCreators = 3
+
+// roleEditor is the MARC relator code of an editor.
+const roleEditor = "edt"
+
+const xmlNamespace = "http://www.w3.org/XML/1998/namespace"
+
+// metadataOptions are the user's preferences for choosing between metadata
+// values.
+type metadataOptions struct {
+	// titleLang picks the title whose xml:lang matches, e.g. "en" for "en-GB"
+	titleLang string
+	// rendition is the --rendition to read in books listing several
+	rendition string
+	// suspiciousTitles are lower case placeholder titles such as
+	// "untitled", which are warned about and, with suspiciousFallback,
+	// passed over for the next title found
+	suspiciousTitles   map[string]bool
+	suspiciousFallback bool
+	// anthologyRoles are the creator roles preferred for the author of an
+	// anthology, in order
+	anthologyRoles []string
+}
+
+// defaultSuspiciousTitles are the placeholder titles tools tend to leave
+// behind.
+const defaultSuspiciousTitles = "unknown,untitled,calibre,title,no title"
+
+// fileNameExts are the extensions that give away a title which is really
+// the name of a file, as when a converter falls back to the OPF's name.
+var fileNameExts = map[string]bool{
+	".opf": true, ".epub": true, ".html": true, ".xhtml": true, ".htm": true,
+	".doc": true, ".docx": true, ".odt": true, ".rtf": true, ".txt": true, ".pdf": true,
+}
+
+// setAnthologyRoles parses the comma separated --anthology-roles.
+func (m *metadataOptions) setAnthologyRoles(roles string) {
+	m.anthologyRoles = nil
+	for _, role := range strings.Split(roles, ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			m.anthologyRoles = append(m.anthologyRoles, strings.ToLower(role))
+		}
+	}
+}
+
+// setSuspiciousTitles parses the comma separated --suspicious-titles.
+func (m *metadataOptions) setSuspiciousTitles(titles string) {
+	m.suspiciousTitles = map[string]bool{}
+	for _, title := range strings.Split(titles, ",") {
+		if title = strings.TrimSpace(title); title != "" {
+			m.suspiciousTitles[strings.ToLower(title)] = true
+		}
+	}
+}
+
+// suspicious reports whether title looks like a placeholder rather than
+// the book's real title.
+func (m *metadataOptions) suspicious(title string) bool {
+	title = strings.ToLower(strings.TrimSpace(title))
+	if title == "" {
+		return false
+	}
+
+	return m.suspiciousTitles[title] || fileNameExts[path.Ext(title)] && !strings.Contains(title, " ")
+}
+
+type EpubMetadataParseError struct{}
+
+func (e *EpubMetadataParseError) Error() string {
+	return "failed to find epub opf"
+}
+
+// opfReader skips the leading UTF-8 byte order mark some OPFs are written
+// with, which the xml decoder treats as stray character data before the
+// prolog.
+func opfReader(r io.Reader) io.Reader {
+	br := bufio.NewReader(r)
+	if bom, err := br.Peek(3); err == nil && bytes.Equal(bom, []byte("\xef\xbb\xbf")) {
+		br.Discard(3)
+	}
+
+	return br
+}
+
+// decodeOPF decodes the OPF in file as it is read. The entry is only read a
+// second time, for scanMetadata, when the strict decoding finds no title.
+func decodeOPF(file *zip.File) (*opfPackage, error) {
+	rc, err := openEntry(file)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	decoder := xml.NewDecoder(opfReader(rc))
+	decoder.CharsetReader = charset.NewReaderLabel
+
+	var pkg opfPackage
+	if err := decoder.Decode(&pkg); err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(pkg.XMLName.Local, "package") {
+		// e.g. an HTML fragment saved as .opf, whose empty metadata would
+		// otherwise name the book Unknown-Unknown
+		return nil, errors.New("OPF is not a valid package document (root element is <" + pkg.XMLName.Local + ">)")
+	}
+
+	if len(pkg.Metadata.Titles) == 0 {
+		// fall back to a scan that doesn't care where or how the dc
+		// elements are written
+		if rescan, err := openEntry(file); err == nil {
+			md, err := scanMetadata(rescan)
+			rescan.Close()
+			if err == nil && len(md.Titles) > 0 {
+				pkg.Metadata = md
+			}
+		}
+	}
+
+	return &pkg, nil
+}
+
+// scanMetadata collects the metadata elements anywhere in an OPF, matching
+// their local names case-insensitively. This finds what the strict decoding
+// misses in OEB 1.x packages, which nest <dc:Title> and friends in a
+// <dc-metadata> element, and in others that wrap them in something of their
+// own.
+func scanMetadata(r io.Reader) (opfMetadata, error) {
+	decoder := xml.NewDecoder(opfReader(r))
+	decoder.CharsetReader = charset.NewReaderLabel
+	decoder.Strict = false
+
+	var md opfMetadata
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return md, nil
+		} else if err != nil {
+			return md, err
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		// anything not listed here is a wrapper whose children are scanned
+		switch strings.ToLower(start.Name.Local) {
+		case "title":
+			var title opfTitle
+			err = decoder.DecodeElement(&title, &start)
+			md.Titles = append(md.Titles, title)
+		case "creator":
+			var creator opfCreator
+			err = decoder.DecodeElement(&creator, &start)
+			md.Creators = append(md.Creators, creator)
+		case "date":
+			var date innerText
+			err = decoder.DecodeElement(&date, &start)
+			md.Dates = append(md.Dates, string(date))
+		case "language":
+			var language innerText
+			err = decoder.DecodeElement(&language, &start)
+			md.Languages = append(md.Languages, string(language))
+		case "publisher":
+			var publisher innerText
+			err = decoder.DecodeElement(&publisher, &start)
+			md.Publishers = append(md.Publishers, publisher)
+		case "rights":
+			var rights innerText
+			err = decoder.DecodeElement(&rights, &start)
+			md.Rights = append(md.Rights, rights)
+		case "identifier":
+			var id opfIdentifier
+			err = decoder.DecodeElement(&id, &start)
+			md.Identifiers = append(md.Identifiers, id)
+		case "meta":
+			var meta opfMeta
+			err = decoder.DecodeElement(&meta, &start)
+			md.Metas = append(md.Metas, meta)
+		}
+		if err != nil {
+			return md, err
+		}
+	}
+}
+
+func (pkg *opfPackage) bookData(mopts *metadataOptions) BookData {
+	md := &pkg.Metadata
+
+	var data BookData
+	var skip func(string) bool
+	if mopts.suspiciousFallback {
+		skip = mopts.suspicious
+	}
+	data.Title = md.title(mopts.titleLang, skip)
+	creators := md.creators()
+	for _, creator := range creators {
+		data.Authors = append(data.Authors, string(creator.Name))
+		if creator.Role == roleEditor && data.Editor == "" {
+			data.Editor = string(creator.Name)
+		}
+	}
+	data.Author = first(data.Authors)
+	if len(creators) >= anthologyCreators {
+		data.Author = preferredCreator(creators, mopts.anthologyRoles, data.Author)
+	}
+	data.ChapterCount = len(pkg.Spine.Itemrefs)
+	data.Language = first(md.Languages)
+	data.Publisher = first(md.Publishers)
+	data.Rights = first(md.Rights)
+
+	if date := first(md.Dates); len(date) >= 4 && isDigits(date[:4]) {
+		data.Year = date[:4]
+	}
+
+	for _, id := range md.Identifiers {
+		if isbn := id.isbn(); isbn != "" && data.ISBN == "" {
+			data.ISBN = isbn
+		}
+		if pkg.UniqueIdentifier != "" && id.ID == pkg.UniqueIdentifier {
+			data.UID = strings.TrimSpace(id.Value)
+		}
+	}
+
+	for _, meta := range md.Metas {
+		if _, seen := data.Meta[meta.Name]; meta.Name == "" || seen {
+			continue
+		}
+		if data.Meta == nil {
+			data.Meta = map[string]string{}
+		}
+		data.Meta[meta.Name] = strings.TrimSpace(meta.Content)
+	}
+	for _, meta := range md.Metas {
+		if meta.Property == "dcterms:modified" && data.Modified == "" {
+			data.Modified = isoTimestamp(strings.TrimSpace(meta.Value))
+		}
+	}
+	data.Series, data.SeriesIndex = md.collection()
+	if data.Series == "" {
+		data.Series = data.Meta["calibre:series"]
+		data.SeriesIndex = data.Meta["calibre:series_index"]
+	}
+	data.TitleSort = data.Meta["calibre:title_sort"]
+	if data.TitleSort == "" {
+		data.TitleSort = sortTitle(data.Title)
+	}
+
+	return data
+}
+
+// creators returns the named creators, with the roles EPUB 3 gives them in
+// refining metas filled in.
+func (md *opfMetadata) creators() []opfCreator {
+	var creators []opfCreator
+	for _, creator := range md.Creators {
+		if creator.Name == "" {
+			continue
+		}
+
+		for _, meta := range md.Metas {
+			if creator.Role == "" && creator.ID != "" && meta.Refines == "#"+creator.ID && meta.Property == "role" {
+				creator.Role = strings.ToLower(strings.TrimSpace(meta.Value))
+			}
+		}
+		creators = append(creators, creator)
+	}
+
+	return creators
+}
+
+// preferredCreator returns the first creator with the earliest of roles, or
+// def when none has any of them.
+func preferredCreator(creators []opfCreator, roles []string, def string) string {
+	for _, role := range roles {
+		for _, creator := range creators {
+			if creator.Role == role {
+				return string(creator.Name)
+			}
+		}
+	}
+
+	return def
+}
+
+// collection returns the name and group-position of the EPUB 3
+// belongs-to-collection the book is in, preferring one refined with a
+// collection-type of series. Collections of another type, such as a set,
+// are ignored.
+func (md *opfMetadata) collection() (name string, position string) {
+	refinements := func(id string) map[string]string {
+		refined := map[string]string{}
+		for _, meta := range md.Metas {
+			if id != "" && meta.Refines == "#"+id && meta.Property != "" {
+				refined[meta.Property] = strings.TrimSpace(meta.Value)
+			}
+		}
+		return refined
+	}
+
+	for _, meta := range md.Metas {
+		value := strings.TrimSpace(meta.Value)
+		if meta.Property != "belongs-to-collection" || meta.Refines != "" || value == "" {
+			continue
+		}
+
+		refined := refinements(meta.ID)
+		switch refined["collection-type"] {
+		case "series":
+			return value, refined["group-position"]
+		case "":
+			if name == "" {
+				name, position = value, refined["group-position"]
+			}
+		}
+	}
+
+	return name, position
+}
+
+// title returns the first title in lang, falling back to the first title
+// when none matches or lang is empty.
+func (md *opfMetadata) title(lang string, skip func(string) bool) string {
+	usable := func(title opfTitle) bool {
+		return title.Text != "" && (skip == nil || !skip(string(title.Text)))
+	}
+
+	if lang != "" {
+		for _, title := range md.Titles {
+			if usable(title) && langMatches(title.Lang, lang) {
+				return string(title.Text)
+			}
+		}
+	}
+
+	for _, title := range md.Titles {
+		if usable(title) {
+			return string(title.Text)
+		}
+	}
+
+	return ""
+}
+
+// langMatches reports whether the language tag tag is want or one of its
+// regional variants.
+func langMatches(tag string, want string) bool {
+	tag = strings.ToLower(strings.ReplaceAll(tag, "_", "-"))
+	want = strings.ToLower(strings.ReplaceAll(want, "_", "-"))
+
+	return tag == want || strings.HasPrefix(tag, want+"-")
+}
+
+// sortArticles are the leading words moved to the end of a derived sort
+// title.
+var sortArticles = []string{"The", "A", "An"}
+
+// sortTitle derives a sort title by moving a leading article to the end, so
+// "The Hobbit" becomes "Hobbit, The".
+func sortTitle(title string) string {
+	for _, article := range sortArticles {
+		if len(title) > len(article)+1 && strings.EqualFold(title[:len(article)], article) && title[len(article)] == ' ' {
+			return strings.TrimSpace(title[len(article)+1:]) + ", " + title[:len(article)]
+		}
+	}
+
+	return title
+}
+
+// isbn returns the identifier's value as a bare ISBN, or "" when the
+// identifier is not an ISBN.
+func (id *opfIdentifier) isbn() string {
+	value := strings.TrimSpace(id.Value)
+	lower := strings.ToLower(value)
+
+	switch {
+	case strings.EqualFold(id.Scheme, "isbn"):
+	case strings.HasPrefix(lower, "urn:isbn:"):
+		value = value[len("urn:isbn:"):]
+	case strings.HasPrefix(lower, "isbn:"):
+		value = value[len("isbn:"):]
+	default:
+		return ""
+	}
+
+	value = strings.NewReplacer("-", "", " ", "").Replace(value)
+	if value == "" {
+		return ""
+	}
+
+	return strings.ToUpper(value)
+}
+
+func first[T ~string](values []T) string {
+	for _, value := range values {
+		if trimmed := strings.TrimSpace(string(value)); trimmed != "" {
+			return trimmed
+		}
+	}
+
+	return ""
+}
+
+// isoLayouts are the forms of ISO 8601 dates found in OPFs, most specific
+// first.
+var isoLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02T15:04Z07:00", "2006-01-02", "2006-01", "2006"}
+
+// isoTimestamp normalizes an ISO 8601 date to RFC 3339 in UTC, keeping
+// values it can't parse as they are.
+func isoTimestamp(value string) string {
+	for _, layout := range isoLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UTC().Format(time.RFC3339)
+		}
+	}
+
+	return value
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+
+	return s != ""
+}
+
+// readEpubData reads the metadata of the OPF that container.xml names for
+// the chosen rendition. Books without a usable container fall back to the
+// first .opf entry in the archive.
+func readEpubData(name string, f *zip.ReadCloser, mopts *metadataOptions) (BookData, error) {
+	file, _, err := findOPF(name, &f.Reader, mopts)
+	if err != nil {
+		return BookData{}, err
+	}
+
+	pkg, err := decodeOPF(file)
+	if err != nil {
+		return BookData{}, err
+	}
+
+	data := pkg.bookData(mopts)
+	if data.Title == "" {
+		if title := navTitle(&f.Reader, file.Name, pkg); !mopts.suspiciousFallback || !mopts.suspicious(title) {
+			data.Title = title
+		}
+		if data.TitleSort == "" {
+			data.TitleSort = sortTitle(data.Title)
+		}
+	}
+
+	return data, nil
+}
+
+// findOPF picks the OPF of the epub name: the rootfile container.xml points
+// to, or else the first .opf entry. origin says which of the two it was.
+func findOPF(name string, r *zip.Reader, mopts *metadataOptions) (file *zip.File, origin string, err error) {
+	container, err := readContainer(r)
+	if err == nil {
+		i, rootfile, err := container.rootfile(mopts.rendition)
+		if err != nil {
+			return nil, "", err
+		}
+
+		if file := findZipFile(r, rootfile.FullPath); file != nil {
+			origin = fmt.Sprintf("container.xml, rendition %d of %d", i+1, len(container.Rootfiles))
+			debugLog.Printf("%s: reading %s from %s", name, file.Name, origin)
+			return file, origin, nil
+		} else if mopts.rendition != "" {
+			return nil, "", errors.New("rendition " + mopts.rendition + " names " + rootfile.FullPath + ", which is missing")
+		}
+
+		err = errors.New(rootfile.FullPath + " is missing")
+	} else if mopts.rendition != "" {
+		return nil, "", err
+	}
+
+	for _, file := range r.File {
+		if strings.HasSuffix(file.Name, ".opf") {
+			origin = "scan for .opf entries, " + err.Error()
+			debugLog.Printf("%s: reading %s from %s", name, file.Name, origin)
+			return file, origin, nil
+		}
+	}
+
+	return nil, "", &EpubMetadataParseError{}
+}
+
+// listOPFPaths prints which OPF each of files would be read from, for
+// --list-opf-path, and returns how many had none.
+func listOPFPaths(w io.Writer, files []string, mopts *metadataOptions) int {
+	failed := 0
+	for _, file := range files {
+		f, err := zip.OpenReader(file)
+		if err != nil {
+			failed++
+			log.Print(file + ": " + err.Error())
+			continue
+		}
+
+		opf, origin, err := findOPF(file, &f.Reader, mopts)
+		f.Close()
+		if err != nil {
+			failed++
+			log.Print(file + ": " + err.Error())
+			continue
+		}
+
+		fmt.Fprintf(w, "%s: %s (%s)\n", file, opf.Name, origin)
+	}
+
+	return failed
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func decodeFixture(t *testing.T, name string) BookData {
+	t.Helper()
+
+	pkg, err := decodeOPF(fixtureEntry(t, name, "content.opf"))
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+
+	return pkg.bookData(&metadataOptions{})
+}
+
+// The strict decoding finds no title in these real-world packages, which
+// the fallback scan has to recover.
+func TestDecodeOPFMalformedMetadata(t *testing.T) {
+	tests := []struct {
+		fixture string
+		title   string
+		author  string
+	}{
+		{"opf/oeb1-dc-metadata.opf", "The Time Machine", "H. G. Wells"},
+		{"opf/undeclared-dc-prefix.opf", "The War of the Worlds", "H. G. Wells"},
+		{"opf/opf-prefixed-wrapper.opf", "The Invisible Man", "H. G. Wells"},
+	}
+
+	for _, test := range tests {
+		data := decodeFixture(t, test.fixture)
+		if data.Title != test.title || data.Author != test.author {
+			t.Errorf("%s: got %q by %q, want %q by %q", test.fixture, data.Title, data.Author, test.title, test.author)
+		}
+	}
+}
+
+func TestDecodeOPFEncodings(t *testing.T) {
+	tests := []struct {
+		fixture string
+		title   string
+		author  string
+	}{
+		// starts with a UTF-8 byte order mark
+		{"opf/utf8-bom.opf", "Emma", "Jane Austen"},
+		// the prolog declares the encoding, which CharsetReader decodes
+		{"opf/iso-8859-1.opf", "Les Misérables", "Victor Hugo"},
+	}
+
+	for _, test := range tests {
+		data := decodeFixture(t, test.fixture)
+		if data.Title != test.title || data.Author != test.author {
+			t.Errorf("%s: got %q by %q, want %q by %q", test.fixture, data.Title, data.Author, test.title, test.author)
+		}
+	}
+}
+
+// Markup inside dc:title or dc:creator must not cut their text short.
+func TestDecodeOPFNestedMarkup(t *testing.T) {
+	data := decodeFixture(t, "opf/nested-markup-title.opf")
+	if data.Title != "The Great Gatsby" || data.Author != "F. Scott Fitzgerald" {
+		t.Errorf("got %q by %q, want %q by %q", data.Title, data.Author, "The Great Gatsby", "F. Scott Fitzgerald")
+	}
+}
+
+func TestResolveHref(t *testing.T) {
+	tests := []struct {
+		opfPath string
+		href    string
+		want    string
+	}{
+		{"content.opf", "images/cover.jpg", "images/cover.jpg"},
+		{"OEBPS/content.opf", "images/cover.jpg", "OEBPS/images/cover.jpg"},
+		{"OEBPS/content.opf", "../cover.jpg", "cover.jpg"},
+		{"OEBPS/content.opf", "text/chapter%201.xhtml#start", "OEBPS/text/chapter 1.xhtml"},
+	}
+
+	for _, test := range tests {
+		if got := resolveHref(test.opfPath, test.href); got != test.want {
+			t.Errorf("resolveHref(%q, %q) = %q, want %q", test.opfPath, test.href, got, test.want)
+		}
+	}
+}
+
+// testdata/oebps keeps its OPF under OEBPS/ and its cover in OEBPS/images/,
+// which the manifest refers to relative to the OPF.
+func TestOPFInSubdirectory(t *testing.T) {
+	path, err := zipDirectory("testdata/oebps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	for _, check := range validateEpub(path) {
+		if check.err != nil {
+			t.Errorf("%s: %v", check.name, check.err)
+		}
+	}
+
+	data, _, err := readBook(path, path, &options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Title != "The Hobbit" {
+		t.Errorf("got title %q, want %q", data.Title, "The Hobbit")
+	}
+}
+
+// An OPF whose root isn't a package decodes without error into empty
+// metadata, so it is rejected instead.
+func TestDecodeOPFBogusRoot(t *testing.T) {
+	_, err := decodeOPF(fixtureEntry(t, "opf/html-fragment.opf", "content.opf"))
+	if err == nil || !strings.Contains(err.Error(), "not a valid package document (root element is <html>)") {
+		t.Errorf("got %v, want a not a valid package document error", err)
+	}
+}
+
+// The series comes from the belongs-to-collection refined as a series,
+// not from the set listed before it.
+func TestDecodeOPFBelongsToCollection(t *testing.T) {
+	data := decodeFixture(t, "opf/belongs-to-collection.opf")
+	if data.Series != "Culture" || data.SeriesIndex != "2" {
+		t.Errorf("got series %q #%q, want %q #%q", data.Series, data.SeriesIndex, "Culture", "2")
+	}
+}
+
+func TestCollectionWithoutType(t *testing.T) {
+	md := opfMetadata{Metas: []opfMeta{
+		{Property: "belongs-to-collection", ID: "c1", Value: " Discworld "},
+		{Property: "group-position", Refines: "#c1", Value: "7"},
+	}}
+	if name, position := md.collection(); name != "Discworld" || position != "7" {
+		t.Errorf("got %q #%q, want %q #%q", name, position, "Discworld", "7")
+	}
+}
+
+// largeOPF is an OPF 2 package with several megabytes of description and
+// thousands of spine items around the metadata elements in head and tail.
+// Without dc, the metadata element doesn't declare the dc prefix, which
+// leaves the strict decoding with nothing.
+func largeOPF(head string, tail string, dc bool) string {
+	namespaces := ` xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:opf="http://www.idpf.org/2007/opf"`
+	if !dc {
+		namespaces = ""
+	}
+
+	var manifest, spine strings.Builder
+	for i := 0; i < 5000; i++ {
+		id := "c" + strconv.Itoa(i)
+		manifest.WriteString(`<item id="` + id + `" href="` + id + `.xhtml" media-type="application/xhtml+xml"/>` + "\n")
+		spine.WriteString(`<itemref idref="` + id + `"/>` + "\n")
+	}
+
+	return `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="2.0" unique-identifier="bookid">
+  <metadata` + namespaces + `>
+    ` + head + `
+    <dc:description>` + strings.Repeat("It was a bright cold day in April, and the clocks were striking thirteen. ", 64<<10) + `</dc:description>
+    ` + tail + `
+  </metadata>
+  <manifest>` + manifest.String() + `</manifest>
+  <spine>` + spine.String() + `</spine>
+</package>`
+}
+
+// Multi-megabyte packages decode as they are streamed, wherever the title
+// and creators are in them, including through the fallback scan.
+func TestReadLargeOPF(t *testing.T) {
+	metadata := `<dc:title>Nineteen Eighty-Four</dc:title>
+    <dc:creator opf:role="aut">George Orwell</dc:creator>
+    <dc:creator opf:role="edt">Peter Davison</dc:creator>`
+	wrapped := "<bookinfo>" + strings.ReplaceAll(metadata, ` opf:role="edt"`, "") + "</bookinfo>"
+
+	dir := t.TempDir()
+	for _, test := range []struct {
+		name string
+		opf  string
+	}{
+		{"metadata first", largeOPF(metadata, "", true)},
+		{"metadata after the padding", largeOPF("", metadata, true)},
+		{"fallback scan after the padding", largeOPF("", wrapped, false)},
+	} {
+		if len(test.opf) < 4<<20 {
+			t.Fatalf("%s: the OPF is only %d bytes", test.name, len(test.opf))
+		}
+		path := writeEpub(t, dir, test.name+".epub", epubEntries("OEBPS/content.opf", test.opf))
+
+		data, _, err := readBook(path, path, &options{})
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if data.Title != "Nineteen Eighty-Four" || strings.Join(data.Authors, ", ") != "George Orwell, Peter Davison" {
+			t.Errorf("%s: got %q by %q, want Nineteen Eighty-Four by George Orwell and Peter Davison", test.name, data.Title, data.Authors)
+		}
+		if data.ChapterCount != 5000 {
+			t.Errorf("%s: got %d chapters, want 5000", test.name, data.ChapterCount)
+		}
+	}
+}
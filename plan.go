@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/mattn/go-isatty"
+)
+
+// planRun resolves the target of every job without writing anything, for
+// the confirmation asked before a destructive run. The metadata read for a
+// job is kept in it for the real run. Downloads and exploded directories
+// aren't fetched or zipped just for the plan; they are left out of the
+// results and counted in unplanned. The resolver's claims are dropped
+// afterwards so the real run starts from a clean slate.
+func planRun(jobs []job, opts *options) (results []Result, unplanned int) {
+	opts.dryRun = true
+	defer func() {
+		opts.dryRun = false
+		opts.resolver.claimed = nil
+	}()
+
+	planned := make([]Result, len(jobs))
+	skipped := make([]bool, len(jobs))
+	forEach(len(jobs), opts.workers, func(i int) {
+		j := &jobs[i]
+		if j.duplicateOf == "" && j.filename == "" {
+			if j.path == "" && (isURL(j.file) || isExplodedEpub(j.file)) {
+				skipped[i] = true
+				return
+			}
+			j.named = &namedBook{}
+		}
+		planned[i] = j.process(context.Background(), opts)
+	})
+
+	for i := range planned {
+		if skipped[i] {
+			unplanned++
+		} else {
+			results = append(results, planned[i])
+		}
+	}
+
+	return results, unplanned
+}
+
+// planSummary counts the planned results that would move a local input and
+// those that would overwrite an existing file.
+func planSummary(results []Result, opts *options) (moves int, overwrites int) {
+	var t tally
+	for i := range results {
+		t.add(&results[i], opts)
+	}
+
+	return t.moves, t.overwrites
+}
+
+// confirm asks on the terminal whether to go ahead with the run. unplanned
+// inputs aren't in the counts.
+func confirm(moves int, overwrites int, unplanned int) bool {
+	fmt.Fprintf(os.Stderr, "%d files will be moved and %d existing files overwritten", moves, overwrites)
+	if unplanned > 0 {
+		fmt.Fprintf(os.Stderr, ", not counting %d downloads and directories", unplanned)
+	}
+	fmt.Fprint(os.Stderr, ". Continue? [y/N] ")
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "no answer; pass --yes to run without confirmation")
+		return false
+	}
+
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// isTerminal reports whether f is a terminal rather than a pipe, a file or
+// /dev/null.
+func isTerminal(f *os.File) bool {
+	return isatty.IsTerminal(f.Fd()) || isatty.IsCygwinTerminal(f.Fd())
+}
+
+// printEmptyNames lists the files a dry run found whose name renders empty,
+// which is usually a template leaning on a field some books don't have.
+func printEmptyNames(empty []string) {
+	if len(empty) == 0 {
+		return
+	}
+	sort.Strings(empty)
+
+	fmt.Printf("%d files render an empty name and would be skipped:\n", len(empty))
+	for _, file := range empty {
+		fmt.Println("  " + file)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// The metadata read for the confirmation's plan is reused by the real run,
+// and downloads are left out of the plan instead of being fetched twice.
+func TestPlanRunReadsEachBookOnce(t *testing.T) {
+	defer func(reader func(string, string, *options) (BookData, string, error)) {
+		bookReader = reader
+	}(bookReader)
+	var reads int32
+	bookReader = func(file string, path string, opts *options) (BookData, string, error) {
+		atomic.AddInt32(&reads, 1)
+		return BookData{Title: strings.TrimSuffix(filepath.Base(file), ".epub"), Author: "Author"}, ".epub", nil
+	}
+
+	opts := options{outputDirectory: t.TempDir(), workers: 2, resolver: targetResolver{policy: conflictOverwrite}}
+	jobs := []job{{file: "a.epub"}, {file: "b.epub"}, {file: "https://example.com/c.epub"}, {file: "a.epub", duplicateOf: "a.epub"}}
+
+	results, unplanned := planRun(jobs, &opts)
+	if len(results) != 3 || unplanned != 1 {
+		t.Errorf("got %d planned and %d unplanned, want 3 and 1", len(results), unplanned)
+	}
+	if opts.dryRun || opts.resolver.claimed != nil {
+		t.Error("the plan left the options in dry-run state")
+	}
+
+	opts.dryRun = true
+	for _, j := range jobs[:2] {
+		if res := j.process(context.Background(), &opts); res.Status != statusPlanned {
+			t.Errorf("%s: got %v (%v), want it planned", j.file, res.Status, res.Err)
+		}
+	}
+	if reads != 2 {
+		t.Errorf("the books were read %d times, want 2", reads)
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	reportJSON = "json"
+	reportCSV  = "csv"
+)
+
+func (s status) String() string {
+	switch s {
+	case statusSucceeded:
+		return "succeeded"
+	case statusSkipped:
+		return "skipped"
+	case statusPlanned:
+		return "planned"
+	}
+
+	return "failed"
+}
+
+type reportEntry struct {
+	Source   string      `json:"source"`
+	Target   string      `json:"target,omitempty"`
+	Status   string      `json:"status"`
+	Error    string      `json:"error,omitempty"`
+	Metadata *BookData   `json:"metadata,omitempty"`
+	Hook     *hookResult `json:"hook,omitempty"`
+	Warnings []string    `json:"warnings,omitempty"`
+}
+
+func newReportEntry(result *Result) reportEntry {
+	entry := reportEntry{
+		Source:   result.File,
+		Target:   result.Target,
+		Status:   result.Status.String(),
+		Metadata: result.Data,
+		Hook:     result.Hook,
+		Warnings: result.Warnings,
+	}
+	if result.Err != nil {
+		entry.Error = result.Err.Error()
+	}
+
+	return entry
+}
+
+func validReportFormat(format string) bool {
+	return format == "" || format == reportJSON || format == reportCSV
+}
+
+// resultWriter writes results one at a time as they come in, so that a run
+// doesn't have to keep them all to report on them.
+type resultWriter interface {
+	write(result *Result) error
+	// close finishes the output after the last result
+	close() error
+}
+
+func newReportWriter(w io.Writer, format string) (resultWriter, error) {
+	switch format {
+	case reportJSON:
+		return &jsonReportWriter{w: w, end: "\n"}, nil
+	case reportCSV:
+		return newCSVReportWriter(w)
+	}
+
+	return nil, fmt.Errorf("unknown report format: %s", format)
+}
+
+// jsonReportWriter writes a JSON array of reportEntry, one element per
+// result, indented as if it were nested indent deep and followed by end.
+type jsonReportWriter struct {
+	w      io.Writer
+	indent string
+	end    string
+	count  int
+}
+
+func (jw *jsonReportWriter) write(result *Result) error {
+	entry, err := json.MarshalIndent(newReportEntry(result), jw.indent+"  ", "  ")
+	if err != nil {
+		return err
+	}
+
+	separator := ",\n"
+	if jw.count == 0 {
+		separator = "[\n"
+	}
+	jw.count++
+
+	_, err = fmt.Fprintf(jw.w, "%s%s  %s", separator, jw.indent, entry)
+	return err
+}
+
+func (jw *jsonReportWriter) close() error {
+	if jw.count == 0 {
+		_, err := fmt.Fprint(jw.w, "[]"+jw.end)
+		return err
+	}
+
+	_, err := fmt.Fprintf(jw.w, "\n%s]%s", jw.indent, jw.end)
+	return err
+}
+
+// csvReportWriter writes one row per result. The metadata columns are taken
+// from the json tags of BookData so new fields show up without changes here.
+type csvReportWriter struct {
+	cw *csv.Writer
+}
+
+func newCSVReportWriter(w io.Writer) (*csvReportWriter, error) {
+	cw := csv.NewWriter(w)
+
+	t := reflect.TypeOf(BookData{})
+	header := []string{"source", "target", "status", "error", "hook_exit_code", "hook_error", "warnings"}
+	for i := 0; i < t.NumField(); i++ {
+		header = append(header, strings.Split(t.Field(i).Tag.Get("json"), ",")[0])
+	}
+	if err := cw.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &csvReportWriter{cw: cw}, nil
+}
+
+func (w *csvReportWriter) write(result *Result) error {
+	entry := newReportEntry(result)
+	row := []string{entry.Source, entry.Target, entry.Status, entry.Error, "", "", strings.Join(entry.Warnings, "; ")}
+	if entry.Hook != nil {
+		row[4] = strconv.Itoa(entry.Hook.ExitCode)
+		row[5] = entry.Hook.Error
+	}
+
+	data := BookData{}
+	if entry.Metadata != nil {
+		data = *entry.Metadata
+	}
+
+	v := reflect.ValueOf(data)
+	for j := 0; j < v.NumField(); j++ {
+		row = append(row, csvValue(v.Field(j)))
+	}
+
+	if err := w.cw.Write(row); err != nil {
+		return err
+	}
+
+	// flushed per row so the report is streamed rather than buffered
+	w.cw.Flush()
+	return w.cw.Error()
+}
+
+func (w *csvReportWriter) close() error {
+	w.cw.Flush()
+	return w.cw.Error()
+}
+
+func csvValue(v reflect.Value) string {
+	if v.Kind() == reflect.Slice || v.Kind() == reflect.Map {
+		return strings.Join(fieldValues(v), "; ")
+	}
+
+	return fmt.Sprint(v.Interface())
+}
+
+// fieldValues lists the values of a BookData field: the elements of a
+// slice, the key=value pairs of a map sorted by key, or the field itself.
+func fieldValues(v reflect.Value) []string {
+	var values []string
+	switch v.Kind() {
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			values = append(values, fmt.Sprint(v.Index(i).Interface()))
+		}
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			values = append(values, fmt.Sprint(key.Interface())+"="+fmt.Sprint(v.MapIndex(key).Interface()))
+		}
+		sort.Strings(values)
+	default:
+		values = append(values, fmt.Sprint(v.Interface()))
+	}
+
+	return values
+}
+
+// bookDataField returns the index of the BookData field whose json name is
+// name.
+func bookDataField(name string) (int, bool) {
+	t := reflect.TypeOf(BookData{})
+	for i := 0; i < t.NumField(); i++ {
+		if strings.Split(t.Field(i).Tag.Get("json"), ",")[0] == name {
+			return i, true
+		}
+	}
+
+	return 0, false
+}
+
+// groupCounts counts the successfully processed books by the value of a
+// BookData field for --group-report. List fields such as authors count the
+// book once under each of their values.
+type groupCounts struct {
+	field  int
+	counts map[string]int
+}
+
+func newGroupCounts(field int) *groupCounts {
+	return &groupCounts{field: field, counts: map[string]int{}}
+}
+
+func (g *groupCounts) add(result *Result) {
+	if result.Status != statusSucceeded || result.Data == nil {
+		return
+	}
+
+	keys := fieldValues(reflect.ValueOf(*result.Data).Field(g.field))
+	if len(keys) == 0 {
+		keys = append(keys, "")
+	}
+
+	for _, key := range keys {
+		g.counts[key]++
+	}
+}
+
+// print writes the counts, most common first.
+func (g *groupCounts) print(w io.Writer) {
+	counts := g.counts
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, key := range keys {
+		if key == "" {
+			fmt.Fprintf(tw, "%d\t(none)\n", counts[key])
+		} else {
+			fmt.Fprintf(tw, "%d\t%s\n", counts[key], key)
+		}
+	}
+	tw.Flush()
+}
+
+// tally keeps the counts the summary is made of, updated as each result
+// comes in.
+type tally struct {
+	total, succeeded, failed, skipped, planned int
+	// moves and overwrites are what the planned results would do
+	moves, overwrites    int
+	hookFailures, warned int
+	// emptyNames are the files whose name a dry run found renders empty
+	emptyNames []string
+}
+
+func (t *tally) add(result *Result, opts *options) {
+	t.total++
+	switch result.Status {
+	case statusSucceeded:
+		t.succeeded++
+	case statusSkipped:
+		t.skipped++
+	case statusPlanned:
+		t.planned++
+		if opts.move && result.path == result.File {
+			t.moves++
+		}
+		if result.replaces {
+			t.overwrites++
+		}
+	default:
+		t.failed++
+	}
+
+	if result.Hook.failed() {
+		t.hookFailures++
+	}
+	if len(result.Warnings) > 0 {
+		t.warned++
+	}
+	if errors.Is(result.Err, errEmptyName) {
+		t.emptyNames = append(t.emptyNames, result.File)
+	}
+}
+
+// summaryWriter streams what --summary-file writes: a JSON object with the
+// same entries as --report json under "results", followed by the totals of
+// the run once it is over.
+type summaryWriter struct {
+	f       *os.File
+	results jsonReportWriter
+}
+
+// newSummaryWriter creates the summary file at path along with its parent
+// directories.
+func newSummaryWriter(path string) (*summaryWriter, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprint(f, "{\n  \"results\": "); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &summaryWriter{f: f, results: jsonReportWriter{w: f, indent: "  "}}, nil
+}
+
+func (sw *summaryWriter) write(result *Result) error {
+	return sw.results.write(result)
+}
+
+// finish writes the totals from t and closes the file.
+func (sw *summaryWriter) finish(t *tally) error {
+	err := sw.results.close()
+	if err == nil {
+		_, err = fmt.Fprintf(sw.f, ",\n  \"total\": %d,\n  \"succeeded\": %d,\n  \"failed\": %d,\n  \"skipped\": %d", t.total, t.succeeded, t.failed, t.skipped)
+	}
+	if err == nil && t.planned > 0 {
+		_, err = fmt.Fprintf(sw.f, ",\n  \"planned\": %d", t.planned)
+	}
+	if err == nil {
+		_, err = fmt.Fprint(sw.f, "\n}\n")
+	}
+
+	if closeErr := sw.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// readFailedReport returns the sources a previous --report json run failed
+// on, for --only-failed. Sources that no longer exist are returned
+// separately rather than as inputs.
+func readFailedReport(path string) (sources []string, missing []string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	var entries []reportEntry
+	if err = json.NewDecoder(f).Decode(&entries); err != nil {
+		return nil, nil, errors.New(path + ": " + err.Error())
+	}
+
+	for _, entry := range entries {
+		if entry.Status != statusFailed.String() {
+			continue
+		}
+
+		if !isURL(entry.Source) {
+			if _, err := os.Stat(entry.Source); err != nil {
+				missing = append(missing, entry.Source)
+				continue
+			}
+		}
+
+		sources = append(sources, entry.Source)
+	}
+
+	return sources, missing, nil
+}
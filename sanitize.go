@@ -0,0 +1,183 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	normalizeNFC  = "nfc"
+	normalizeNFD  = "nfd"
+	normalizeNone = "none"
+)
+
+var (
+	asciiFieldRun      = regexp.MustCompile(`[^a-zA-Z0-9]+`)
+	unicodeFieldRun    = regexp.MustCompile(`[^\p{L}\p{M}\p{N}]+`)
+	asciiTemplateRun   = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+	unicodeTemplateRun = regexp.MustCompile(`[^\p{L}\p{M}\p{N}._-]+`)
+	// with --keep-spaces, spaces survive template sanitization
+	spacedTemplateRun = regexp.MustCompile(`[^\p{L}\p{M}\p{N}._ -]+`)
+)
+
+// sanitizer turns metadata into something safe to use as a file name.
+type sanitizer struct {
+	// unicode keeps letters and digits from every script instead of only
+	// ASCII ones
+	unicode   bool
+	normalize string
+	// canonical replaces typographic punctuation with its ASCII equivalent
+	// before anything else
+	canonical bool
+	// separator joins the title and author of the default name, and may be
+	// empty
+	separator string
+	// keepSpaces, with unicode, separates words with single spaces
+	// instead of underscores
+	keepSpaces bool
+	// collapseSame drops the author from the default name when it is the
+	// same as the title
+	collapseSame bool
+	// minimal only strips the illegal characters and replaces whitespace
+	// with the separator, keeping all other punctuation and letters as they
+	// are
+	minimal bool
+	illegal string
+}
+
+// defaultIllegalChars are the characters --minimal-sanitize strips by
+// default, those Windows forbids in names. Path separators and control
+// characters are always stripped.
+const defaultIllegalChars = `/\:*?"<>|`
+
+// minimalField strips the illegal characters from value and replaces each
+// run of whitespace with the separator, or a space with keepSpaces.
+func (s *sanitizer) minimalField(value string) string {
+	value = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == '/' || r == '\\' || strings.ContainsRune(s.illegal, r) {
+			return -1
+		}
+		return r
+	}, s.normalized(value))
+
+	space := s.separator
+	if s.keepSpaces {
+		space = " "
+	}
+
+	// a leading or trailing dot or space is trouble on Windows and hides
+	// the file elsewhere
+	return strings.Trim(strings.Join(strings.Fields(value), space), "_. ")
+}
+
+// canonicalPunctuation maps the typographic variants publishers disagree on
+// to plain ASCII. Only punctuation is touched; letters are left to
+// --unicode.
+var canonicalPunctuation = strings.NewReplacer(
+	"\u2018", "'", "\u2019", "'", "\u201a", "'", "\u201b", "'", "\u2032", "'",
+	"\u201c", `"`, "\u201d", `"`, "\u201e", `"`, "\u201f", `"`, "\u2033", `"`,
+	"\u2010", "-", "\u2011", "-", "\u2012", "-", "\u2013", "-", "\u2014", "-", "\u2015", "-", "\u2212", "-",
+	"\u2026", "...",
+)
+
+func validNormalization(form string) bool {
+	switch form {
+	case normalizeNFC, normalizeNFD, normalizeNone:
+		return true
+	}
+
+	return false
+}
+
+// field replaces every run of characters other than letters and digits in
+// value with replacement.
+func (s *sanitizer) field(value string, replacement string) string {
+	value = s.canonicalized(value)
+	if s.minimal {
+		return s.minimalField(value)
+	} else if s.unicode && s.keepSpaces {
+		return collapseSpaces(unicodeFieldRun.ReplaceAllString(s.normalized(value), " "))
+	} else if s.unicode {
+		return unicodeFieldRun.ReplaceAllString(s.normalized(value), replacement)
+	}
+
+	return asciiFieldRun.ReplaceAllString(value, replacement)
+}
+
+// name builds the default Title-Author file name with the extension ext. It
+// returns "" when neither field has anything usable left, which an empty
+// separator would otherwise turn into a bare extension.
+func (s *sanitizer) name(data *BookData, ext string) string {
+	title := s.field(data.Title, "_")
+	author := s.field(data.Author, "")
+	if strings.Trim(title+author, "_") == "" {
+		return ""
+	}
+	if s.collapseSame && strings.EqualFold(s.field(data.Title, ""), author) {
+		return s.normalized(title) + ext
+	}
+
+	return s.normalized(title+s.separator+author) + ext
+}
+
+// validSeparator rejects separators that would put a path or control
+// characters into names.
+func validSeparator(separator string) bool {
+	return !strings.ContainsAny(separator, `/\`) && strings.IndexFunc(separator, unicode.IsControl) < 0
+}
+
+// rendered cleans up the output of --template, which may also contain dots,
+// dashes and underscores. It returns "" when nothing usable is left.
+func (s *sanitizer) rendered(value string, ext string) string {
+	value = s.canonicalized(value)
+	run := asciiTemplateRun
+	if s.unicode {
+		run = unicodeTemplateRun
+		value = s.normalized(value)
+	}
+
+	var name string
+	if s.minimal {
+		name = s.minimalField(value)
+	} else if s.unicode && s.keepSpaces {
+		name = strings.Trim(collapseSpaces(spacedTemplateRun.ReplaceAllString(value, " ")), "_. ")
+	} else {
+		name = strings.Trim(run.ReplaceAllString(value, "_"), "_.")
+	}
+	if name == "" {
+		return ""
+	}
+
+	return s.normalized(name) + ext
+}
+
+// normalized applies the --normalize form, so that names which look the same
+// are also byte-for-byte the same regardless of how the metadata encoded
+// combining characters.
+func (s *sanitizer) normalized(value string) string {
+	switch s.normalize {
+	case normalizeNFC:
+		return norm.NFC.String(value)
+	case normalizeNFD:
+		return norm.NFD.String(value)
+	}
+
+	return value
+}
+
+// collapseSpaces turns runs of whitespace into single spaces and trims the
+// ends.
+func collapseSpaces(value string) string {
+	return strings.Join(strings.Fields(value), " ")
+}
+
+func (s *sanitizer) canonicalized(value string) string {
+	if !s.canonical {
+		return value
+	}
+
+	return canonicalPunctuation.Replace(value)
+}
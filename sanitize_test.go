@@ -0,0 +1,132 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// With --keep-spaces, words are separated by exactly one space and names
+// never start or end with one.
+func TestKeepSpaces(t *testing.T) {
+	s := sanitizer{unicode: true, keepSpaces: true}
+
+	for _, test := range []struct {
+		value string
+		want  string
+	}{
+		{"The Left Hand of Darkness", "The Left Hand of Darkness"},
+		{"  Dune:  Messiah ", "Dune Messiah"},
+		{"War\tand\n\nPeace", "War and Peace"},
+		{"Ender's Game!", "Ender s Game"},
+		{"— Les Misérables —", "Les Misérables"},
+		{"...", ""},
+	} {
+		if got := s.field(test.value, "_"); got != test.want {
+			t.Errorf("field(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+
+	for _, test := range []struct {
+		value string
+		want  string
+	}{
+		{"Ursula K. Le Guin - The Dispossessed", "Ursula K. Le Guin - The Dispossessed.epub"},
+		{" . The  Hobbit:  Tolkien . ", "The Hobbit Tolkien.epub"},
+		{"Vol.  1 / Part  2", "Vol. 1 Part 2.epub"},
+	} {
+		got := s.rendered(test.value, ".epub")
+		if got != test.want {
+			t.Errorf("rendered(%q) = %q, want %q", test.value, got, test.want)
+		}
+		name := strings.TrimSuffix(got, ".epub")
+		if strings.Contains(name, "  ") || strings.TrimSpace(name) != name {
+			t.Errorf("rendered(%q) = %q has doubled or edge spaces", test.value, got)
+		}
+	}
+}
+
+// An empty --separator runs the title straight into the author, and a book
+// with nothing usable in either field gets no name rather than a bare
+// extension.
+func TestEmptySeparator(t *testing.T) {
+	s := sanitizer{separator: ""}
+
+	for _, test := range []struct {
+		data BookData
+		want string
+	}{
+		{BookData{Title: "Dune", Author: "Frank Herbert"}, "DuneFrankHerbert.epub"},
+		{BookData{Title: "The Hobbit", Author: "J.R.R. Tolkien"}, "The_HobbitJRRTolkien.epub"},
+		{BookData{Title: "Dune", Author: ""}, "Dune.epub"},
+		{BookData{Title: "", Author: "Frank Herbert"}, "FrankHerbert.epub"},
+		{BookData{Title: "???", Author: "!!!"}, ""},
+		{BookData{}, ""},
+	} {
+		if got := s.name(&test.data, ".epub"); got != test.want {
+			t.Errorf("name(%q, %q) = %q, want %q", test.data.Title, test.data.Author, got, test.want)
+		}
+	}
+
+	for _, separator := range []string{"", "-", " - ", "_by_"} {
+		if !validSeparator(separator) {
+			t.Errorf("validSeparator(%q) = false, want true", separator)
+		}
+	}
+	for _, separator := range []string{"/", `\`, "\x00", "-\n-"} {
+		if validSeparator(separator) {
+			t.Errorf("validSeparator(%q) = true, want false", separator)
+		}
+	}
+}
+
+// --canonical straightens typographic punctuation, so editions that only
+// differ in their quotes and dashes get the same name.
+func TestCanonicalPunctuation(t *testing.T) {
+	s := sanitizer{canonical: true}
+
+	for _, test := range []struct {
+		value string
+		want  string
+	}{
+		{"Ender’s Game", "Ender's Game"},
+		{"“Hello”, ‘world’", `"Hello", 'world'`},
+		{"1914–1918 — A History", "1914-1918 - A History"},
+		{"Wait…", "Wait..."},
+		{"−273 ′ ″", "-273 ' \""},
+		{"Café ¿qué?", "Café ¿qué?"},
+	} {
+		if got := s.canonicalized(test.value); got != test.want {
+			t.Errorf("canonicalized(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+
+	if got := (&sanitizer{}).canonicalized("Ender’s Game"); got != "Ender’s Game" {
+		t.Errorf("without --canonical got %q, want the value unchanged", got)
+	}
+
+	minimal := sanitizer{canonical: true, minimal: true}
+	typographic := minimal.field("Ender’s Game — Part 1", "_")
+	plain := minimal.field("Ender's Game - Part 1", "_")
+	if typographic != plain {
+		t.Errorf("got %q and %q, want the same name for both editions", typographic, plain)
+	}
+}
+
+// --minimal-sanitize separates words with the --separator, as it does the
+// title and author, keeping the rest of the punctuation.
+func TestMinimalSeparator(t *testing.T) {
+	for _, test := range []struct {
+		s    sanitizer
+		want string
+	}{
+		{sanitizer{minimal: true, separator: "-", illegal: defaultIllegalChars}, "Ender's-Game-(Book-1)-Orson-Scott-Card.epub"},
+		{sanitizer{minimal: true, separator: "_", illegal: defaultIllegalChars}, "Ender's_Game_(Book_1)_Orson_Scott_Card.epub"},
+		{sanitizer{minimal: true, separator: "", illegal: defaultIllegalChars}, "Ender'sGame(Book1)OrsonScottCard.epub"},
+		{sanitizer{minimal: true, separator: "-", keepSpaces: true, illegal: defaultIllegalChars}, "Ender's Game (Book 1)-Orson Scott Card.epub"},
+	} {
+		data := BookData{Title: " Ender's Game:  (Book 1) ", Author: "Orson Scott Card"}
+		if got := test.s.name(&data, ".epub"); got != test.want {
+			t.Errorf("separator %q: got %q, want %q", test.s.separator, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sidecarPath is where --write-opf puts the OPF of the book at target: next
+// to it, under the same name.
+func sidecarPath(target string) string {
+	return strings.TrimSuffix(target, filepath.Ext(target)) + ".opf"
+}
+
+// writeSidecar writes a minimal OPF 2 package holding the Dublin Core
+// fields of data to path, along with the calibre: metas Calibre reads the
+// series and sort title from. The package always gets a unique identifier:
+// the book's own, else its ISBN, else a new UUID.
+func writeSidecar(path string, data *BookData) error {
+	uid := data.UID
+	if uid == "" && data.ISBN != "" {
+		uid = "urn:isbn:" + data.ISBN
+	} else if uid == "" {
+		var err error
+		if uid, err = newUUID(); err != nil {
+			return err
+		}
+	}
+
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	b.WriteString(`<package xmlns="http://www.idpf.org/2007/opf" version="2.0" unique-identifier="uuid_id">` + "\n")
+	b.WriteString(`  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:opf="http://www.idpf.org/2007/opf">` + "\n")
+
+	escaped := func(value string) string {
+		var sb strings.Builder
+		xml.EscapeText(&sb, []byte(value))
+		return sb.String()
+	}
+	element := func(name string, attrs string, value string) {
+		if value != "" {
+			b.WriteString("    <" + name + attrs + ">" + escaped(value) + "</" + name + ">\n")
+		}
+	}
+	meta := func(name string, content string) {
+		if content != "" {
+			b.WriteString(`    <meta name="` + name + `" content="` + escaped(content) + `"/>` + "\n")
+		}
+	}
+
+	element("dc:title", "", data.Title)
+	editor := data.Editor
+	for _, author := range data.Authors {
+		role := "aut"
+		if author == editor {
+			role = roleEditor
+			editor = ""
+		}
+		element("dc:creator", ` opf:role="`+role+`"`, author)
+	}
+	element("dc:identifier", ` id="uuid_id"`, uid)
+	element("dc:identifier", ` opf:scheme="ISBN"`, data.ISBN)
+	element("dc:date", "", data.Year)
+	element("dc:language", "", data.Language)
+	element("dc:publisher", "", data.Publisher)
+	element("dc:rights", "", data.Rights)
+	meta("calibre:title_sort", data.TitleSort)
+	meta("calibre:series", data.Series)
+	meta("calibre:series_index", data.SeriesIndex)
+
+	b.WriteString("  </metadata>\n</package>\n")
+	return os.WriteFile(path, b.Bytes(), 0644)
+}
+
+// newUUID returns a random (version 4) UUID as a urn:uuid: URN.
+func newUUID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+
+	return fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:]), nil
+}
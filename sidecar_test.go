@@ -0,0 +1,71 @@
+package main
+
+import (
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// sidecarData writes the sidecar of data and reads it back.
+func sidecarData(t *testing.T, data *BookData) (BookData, string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "book.opf")
+	if err := writeSidecar(path, data); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := openTestZip(t, []zipEntry{{name: "book.opf", content: string(content), method: zip.Deflate}})
+	pkg, err := decodeOPF(r.File[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pkg.bookData(&metadataOptions{}), string(content)
+}
+
+var generatedUID = regexp.MustCompile(`^urn:uuid:[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+// The package's unique-identifier always names an identifier, falling back
+// to the ISBN and then to a generated UUID.
+func TestSidecarIdentifier(t *testing.T) {
+	got, _ := sidecarData(t, &BookData{Title: "Dune", UID: "urn:uuid:0c1a5f3e-7e8d-4b1a-9d3c-2f6e8a9b1c4d", ISBN: "9780441172719"})
+	if got.UID != "urn:uuid:0c1a5f3e-7e8d-4b1a-9d3c-2f6e8a9b1c4d" || got.ISBN != "9780441172719" {
+		t.Errorf("got UID %q and ISBN %q, want the book's own", got.UID, got.ISBN)
+	}
+
+	got, _ = sidecarData(t, &BookData{Title: "Dune", ISBN: "9780441172719"})
+	if got.UID != "urn:isbn:9780441172719" {
+		t.Errorf("got UID %q, want the ISBN", got.UID)
+	}
+
+	first, _ := sidecarData(t, &BookData{Title: "Dune"})
+	second, _ := sidecarData(t, &BookData{Title: "Dune"})
+	if !generatedUID.MatchString(first.UID) || first.UID == second.UID {
+		t.Errorf("got UIDs %q and %q, want two distinct random UUIDs", first.UID, second.UID)
+	}
+}
+
+// The editor keeps the edt role; every other creator is an author.
+func TestSidecarEditorRole(t *testing.T) {
+	data := &BookData{
+		Title:   "The Best American Short Stories",
+		Authors: []string{"Ursula K. Le Guin", "Heidi Pitlor", "Ted Chiang"},
+		Editor:  "Heidi Pitlor",
+	}
+
+	got, content := sidecarData(t, data)
+	if got.Editor != "Heidi Pitlor" || strings.Join(got.Authors, ", ") != strings.Join(data.Authors, ", ") {
+		t.Errorf("got editor %q and creators %q, want %q and %q", got.Editor, got.Authors, data.Editor, data.Authors)
+	}
+	if n := strings.Count(content, `opf:role="edt"`); n != 1 {
+		t.Errorf("%d creators with the edt role, want 1:\n%s", n, content)
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+	"text/template/parse"
+)
+
+// templateFuncs are the helpers available to --template, in addition to the
+// text/template builtins.
+var templateFuncs = template.FuncMap{
+	"default":  templateDefault,
+	"upper":    strings.ToUpper,
+	"lower":    strings.ToLower,
+	"trunc":    templateTrunc,
+	"etAl":     templateEtAl,
+	"stripUrn": templateStripUrn,
+	"pad":      templatePad,
+}
+
+const templateFuncsHelp = `template functions:
+  default VALUE   use VALUE when the piped field is empty, e.g. {{.Author | default "Anonymous"}}
+  upper           convert to upper case
+  lower           convert to lower case
+  trunc N         keep at most the first N characters
+  etAl N [TEXT]   join a list such as .Authors with ", ", keeping only the first N
+                  names followed by TEXT (default "et al") when there are more
+  stripUrn        drop a leading urn:<namespace>: prefix, e.g. {{.UID | stripUrn}}
+  pad N [D]       zero-pad the whole part of a number to N digits, e.g. {{.SeriesIndex | pad 3}}
+                  turns 1.5 into 001.5; with D, round to D decimals (1 -> 001.0)
+  unknown FIELD   the --unknown-title, --unknown-author or --unknown-series text,
+                  e.g. {{.Series | default (unknown "series")}}
+`
+
+func templateDefault(def string, value string) string {
+	if strings.TrimSpace(value) == "" {
+		return def
+	}
+
+	return value
+}
+
+func templateTrunc(n int, value string) string {
+	runes := []rune(value)
+	if n < 0 || len(runes) <= n {
+		return value
+	}
+
+	return string(runes[:n])
+}
+
+// templateEtAl is called as {{.Authors | etAl 2}} or {{.Authors | etAl 2 "u.a."}};
+// the piped list always arrives as the last argument.
+func templateEtAl(n int, args ...interface{}) (string, error) {
+	if len(args) == 0 || len(args) > 2 {
+		return "", fmt.Errorf("expected a threshold, optional text and a list, got %d arguments", len(args)+1)
+	}
+
+	names, ok := args[len(args)-1].([]string)
+	if !ok {
+		return "", fmt.Errorf("can't abbreviate %T, expected a list such as .Authors", args[len(args)-1])
+	}
+
+	text := "et al"
+	if len(args) == 2 {
+		if text, ok = args[0].(string); !ok {
+			return "", fmt.Errorf("text must be a string, got %T", args[0])
+		}
+	}
+
+	if n < 1 || len(names) <= n {
+		return strings.Join(names, ", "), nil
+	}
+
+	return strings.Join(names[:n], ", ") + " " + text, nil
+}
+
+func templateStripUrn(value string) string {
+	if !strings.HasPrefix(strings.ToLower(value), "urn:") {
+		return value
+	}
+
+	parts := strings.SplitN(value, ":", 3)
+	if len(parts) < 3 {
+		return value
+	}
+
+	return parts[2]
+}
+
+// templatePad is called as {{.SeriesIndex | pad 3}} or {{.SeriesIndex | pad 3 1}}.
+// Values that aren't numbers, including an empty index, are left alone.
+func templatePad(width int, args ...interface{}) (string, error) {
+	if len(args) == 0 || len(args) > 2 {
+		return "", fmt.Errorf("expected a width, optional decimals and a number, got %d arguments", len(args)+1)
+	}
+
+	value := strings.TrimSpace(fmt.Sprint(args[len(args)-1]))
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number < 0 || strings.ContainsAny(value, "eE") {
+		return value, nil
+	}
+
+	if len(args) == 2 {
+		decimals, ok := args[0].(int)
+		if !ok || decimals < 0 {
+			return "", fmt.Errorf("decimals must be a non-negative number, got %v", args[0])
+		}
+		value = strconv.FormatFloat(number, 'f', decimals, 64)
+	}
+
+	whole, fraction, found := strings.Cut(value, ".")
+	if len(whole) < width {
+		whole = strings.Repeat("0", width-len(whole)) + whole
+	}
+	if found {
+		return whole + "." + fraction, nil
+	}
+
+	return whole, nil
+}
+
+// placeholders are the texts substituted for missing metadata.
+type placeholders struct {
+	title  string
+	author string
+	series string
+}
+
+func (p *placeholders) lookup(field string) (string, error) {
+	switch strings.ToLower(field) {
+	case "title":
+		return p.title, nil
+	case "author":
+		return p.author, nil
+	case "series":
+		return p.series, nil
+	}
+
+	return "", fmt.Errorf("no placeholder for %q, expected title, author or series", field)
+}
+
+func parseTemplate(text string, p *placeholders) (*template.Template, error) {
+	return template.New("filename").
+		Funcs(templateFuncs).
+		Funcs(template.FuncMap{"unknown": p.lookup}).
+		Parse(text)
+}
+
+// templateUses reports whether tmpl refers to the BookData field name
+// anywhere, so that fields which are costly to fill in (such as .Hash) are
+// only computed for templates that need them.
+func templateUses(tmpl *template.Template, name string) bool {
+	if tmpl == nil || tmpl.Tree == nil {
+		return false
+	}
+
+	return nodeUses(tmpl.Tree.Root, name)
+}
+
+func nodeUses(node parse.Node, name string) bool {
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node == nil {
+			return false
+		}
+		for _, n := range node.Nodes {
+			if nodeUses(n, name) {
+				return true
+			}
+		}
+	case *parse.ActionNode:
+		return nodeUses(node.Pipe, name)
+	case *parse.IfNode:
+		return nodeUses(node.Pipe, name) || nodeUses(node.List, name) || nodeUses(node.ElseList, name)
+	case *parse.RangeNode:
+		return nodeUses(node.Pipe, name) || nodeUses(node.List, name) || nodeUses(node.ElseList, name)
+	case *parse.WithNode:
+		return nodeUses(node.Pipe, name) || nodeUses(node.List, name) || nodeUses(node.ElseList, name)
+	case *parse.TemplateNode:
+		return nodeUses(node.Pipe, name)
+	case *parse.PipeNode:
+		if node == nil {
+			return false
+		}
+		for _, cmd := range node.Cmds {
+			if nodeUses(cmd, name) {
+				return true
+			}
+		}
+	case *parse.CommandNode:
+		for _, arg := range node.Args {
+			if nodeUses(arg, name) {
+				return true
+			}
+		}
+	case *parse.ChainNode:
+		if nodeUses(node.Node, name) {
+			return true
+		}
+		for _, field := range node.Field {
+			if field == name {
+				return true
+			}
+		}
+	case *parse.FieldNode:
+		for _, field := range node.Ident {
+			if field == name {
+				return true
+			}
+		}
+	case *parse.VariableNode:
+		for _, field := range node.Ident[1:] {
+			if field == name {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// renderTemplate executes tmpl for data. A / in the template separates
+// directories, and each segment is sanitized on its own; segments that come
+// out empty (e.g. a missing series, or "..") are dropped. Slashes in the
+// metadata itself are not separators.
+func renderTemplate(tmpl *template.Template, data *BookData, s *sanitizer, ext string) (string, error) {
+	escaped := withoutSlashes(data)
+
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, &escaped); err != nil {
+		return "", err
+	}
+
+	segments := strings.Split(sb.String(), "/")
+	name := s.rendered(segments[len(segments)-1], ext)
+	if name == "" {
+		return "", nil
+	}
+
+	return filepath.Join(append(renderedDirectories(segments[:len(segments)-1], s), name)...), nil
+}
+
+// renderDirectory executes the --dir-template tmpl for data, returning the
+// sanitized directories it names joined into a relative path, which is ""
+// when every segment comes out empty.
+func renderDirectory(tmpl *template.Template, data *BookData, s *sanitizer) (string, error) {
+	escaped := withoutSlashes(data)
+
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, &escaped); err != nil {
+		return "", err
+	}
+
+	return filepath.Join(renderedDirectories(strings.Split(sb.String(), "/"), s)...), nil
+}
+
+func renderedDirectories(segments []string, s *sanitizer) []string {
+	var parts []string
+	for _, segment := range segments {
+		if dir := s.rendered(segment, ""); dir != "" {
+			parts = append(parts, dir)
+		}
+	}
+
+	return parts
+}
+
+var slashReplacer = strings.NewReplacer("/", " ", "\\", " ")
+
+// withoutSlashes copies data with the path separators in its values
+// replaced by spaces, which sanitizing turns into underscores as it would
+// have the separators.
+func withoutSlashes(data *BookData) BookData {
+	escaped := *data
+
+	v := reflect.ValueOf(&escaped).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(slashReplacer.Replace(field.String()))
+		case reflect.Slice:
+			values := make([]string, field.Len())
+			for j := range values {
+				values[j] = slashReplacer.Replace(field.Index(j).String())
+			}
+			field.Set(reflect.ValueOf(values))
+		case reflect.Map:
+			values := make(map[string]string, field.Len())
+			for _, key := range field.MapKeys() {
+				values[key.String()] = slashReplacer.Replace(field.MapIndex(key).String())
+			}
+			field.Set(reflect.ValueOf(values))
+		}
+	}
+
+	return escaped
+}
+
+// printTemplateFields lists the fields of BookData along with the desc and
+// example struct tags, so the listing can't drift from the struct.
+func printTemplateFields(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "FIELD\tDESCRIPTION\tEXAMPLE")
+
+	t := reflect.TypeOf(BookData{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		fmt.Fprintf(tw, ".%s\t%s\t%s\n", field.Name, field.Tag.Get("desc"), field.Tag.Get("example"))
+	}
+
+	tw.Flush()
+}
+
+// sampleBook is the book --template-test renders, matching the example tags
+// of BookData.
+var sampleBook = BookData{
+	Title:        "The Great Gatsby",
+	TitleSort:    "Great Gatsby, The",
+	Author:       "F. Scott Fitzgerald",
+	Authors:      []string{"F. Scott Fitzgerald"},
+	Editor:       "Maxwell Perkins",
+	Series:       "Jazz Age",
+	SeriesIndex:  "2",
+	Year:         "1925",
+	Modified:     "2021-03-14T09:26:53Z",
+	Language:     "en",
+	ISBN:         "9780743273565",
+	Publisher:    "Scribner",
+	Rights:       "Public domain",
+	UID:          "urn:uuid:0c1a5f3e-7e8d-4b1a-9d3c-2f6e8a9b1c4d",
+	ChapterCount: 9,
+	Meta:         map[string]string{"calibre:rating": "8"},
+	Hash:         "3f2a9c1b",
+}
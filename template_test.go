@@ -0,0 +1,64 @@
+package main
+
+import "testing"
+
+func TestTemplatePad(t *testing.T) {
+	tests := []struct {
+		width int
+		args  []interface{}
+		want  string
+	}{
+		{3, []interface{}{"1"}, "001"},
+		{3, []interface{}{"12"}, "012"},
+		{3, []interface{}{"1234"}, "1234"},
+		{3, []interface{}{"1.5"}, "001.5"},
+		{3, []interface{}{"12.25"}, "012.25"},
+		{3, []interface{}{1, "1"}, "001.0"},
+		{3, []interface{}{1, "1.25"}, "001.2"},
+		{2, []interface{}{0, "1.5"}, "02"},
+		{3, []interface{}{" 7 "}, "007"},
+		{3, []interface{}{""}, ""},
+		{3, []interface{}{"IV"}, "IV"},
+		{3, []interface{}{"-1"}, "-1"},
+		{3, []interface{}{"1e3"}, "1e3"},
+	}
+
+	for _, test := range tests {
+		got, err := templatePad(test.width, test.args...)
+		if err != nil {
+			t.Errorf("pad %d %v: %v", test.width, test.args, err)
+		} else if got != test.want {
+			t.Errorf("pad %d %v = %q, want %q", test.width, test.args, got, test.want)
+		}
+	}
+}
+
+func TestTemplatePadErrors(t *testing.T) {
+	for _, args := range [][]interface{}{
+		nil,
+		{1, 2, "3"},
+		{"one", "1"},
+		{-1, "1"},
+	} {
+		if got, err := templatePad(3, args...); err == nil {
+			t.Errorf("pad 3 %v = %q, want an error", args, got)
+		}
+	}
+}
+
+func TestPadInTemplate(t *testing.T) {
+	tmpl, err := parseTemplate(`{{.Series}} {{.SeriesIndex | pad 3}} {{.Title}}`, &placeholders{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for index, want := range map[string]string{"1": "Dune_001_Dune", "1.5": "Dune_001.5_Dune"} {
+		got, err := renderTemplate(tmpl, &BookData{Title: "Dune", Series: "Dune", SeriesIndex: index}, &sanitizer{}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("index %s: got %q, want %q", index, got, want)
+		}
+	}
+}
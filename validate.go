@@ -0,0 +1,146 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+const epubMimetype = "application/epub+zip"
+
+type validationCheck struct {
+	name string
+	err  error
+}
+
+// validateEpub runs the structural checks of --validate against the epub at
+// path. Checks that depend on an earlier failed one are not run.
+func validateEpub(path string) []validationCheck {
+	f, err := zip.OpenReader(path)
+	if err != nil {
+		return []validationCheck{{"zip", err}}
+	}
+	defer f.Close()
+
+	checks := []validationCheck{
+		{"zip", nil},
+		{"mimetype", checkMimetypeEntry(&f.Reader)},
+	}
+
+	container, err := readContainer(&f.Reader)
+	checks = append(checks, validationCheck{"container", err})
+	if err != nil {
+		return checks
+	}
+
+	_, rootfile, _ := container.rootfile("")
+	pkg, err := checkRootfile(&f.Reader, *rootfile)
+	checks = append(checks, validationCheck{"opf", err})
+	if err != nil {
+		return checks
+	}
+
+	checks = append(checks, validationCheck{"manifest", checkManifest(&f.Reader, rootfile.FullPath, pkg)})
+	return checks
+}
+
+// checkMimetypeEntry checks that the archive starts with an uncompressed
+// mimetype entry holding the epub media type, which is what lets tools
+// recognise an epub from its first bytes.
+func checkMimetypeEntry(r *zip.Reader) error {
+	if len(r.File) == 0 || r.File[0].Name != "mimetype" {
+		return errors.New("mimetype is not the first entry")
+	}
+
+	file := r.File[0]
+	if file.Method != zip.Store {
+		return errors.New("mimetype is compressed")
+	}
+
+	rc, err := openEntry(file)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	content, err := io.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+	if string(content) != epubMimetype {
+		return fmt.Errorf("mimetype is %q, not %q", content, epubMimetype)
+	}
+
+	return nil
+}
+
+func checkRootfile(r *zip.Reader, rootfile epubRootfile) (*opfPackage, error) {
+	file := findZipFile(r, rootfile.FullPath)
+	if file == nil {
+		return nil, errors.New(rootfile.FullPath + " named by " + containerPath + " is missing")
+	}
+
+	pkg, err := decodeOPF(file)
+	if err != nil {
+		return nil, errors.New(rootfile.FullPath + ": " + err.Error())
+	}
+
+	return pkg, nil
+}
+
+// checkManifest checks that every item in the manifest of the OPF at opfPath
+// is present in the archive.
+func checkManifest(r *zip.Reader, opfPath string, pkg *opfPackage) error {
+	var missing []string
+	for _, item := range pkg.Manifest {
+		if item.Href == "" || isURL(item.Href) {
+			continue
+		}
+
+		if name := resolveHref(opfPath, item.Href); findZipFile(r, name) == nil {
+			missing = append(missing, name)
+		}
+	}
+
+	if len(missing) > 0 {
+		return errors.New("missing " + strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// validateFiles prints a validation report for files and returns how many
+// of them failed a check.
+func validateFiles(files []string) int {
+	invalid := 0
+	for _, file := range files {
+		checks := validateEpub(file)
+
+		var failures []validationCheck
+		for _, check := range checks {
+			if check.err != nil {
+				failures = append(failures, check)
+			}
+		}
+
+		if len(failures) == 0 {
+			color.Green("%s: ✅", file)
+			continue
+		}
+
+		invalid++
+		color.Red("%s: ❌", file)
+		for _, check := range failures {
+			fmt.Fprintf(os.Stdout, "  %s: %s\n", check.name, check.err)
+		}
+	}
+
+	fmt.Println("valid:", len(files)-invalid)
+	fmt.Println("invalid:", invalid)
+	return invalid
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+type settledFile struct {
+	path string
+	// generation identifies the timer that fired, so a timer that was
+	// superseded by a later event is ignored
+	generation int
+}
+
+// watch processes .epub files created in dir until the watcher fails or ctx
+// is done, passing each result to emit. A file is only processed once delay
+// has passed without further events for it, so downloads still being
+// written (or renamed from a .part file) aren't picked up half-finished.
+func watch(ctx context.Context, dir string, delay time.Duration, opts *options, emit func(*Result)) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	if err = watcher.Add(dir); err != nil {
+		return err
+	}
+
+	generations := map[string]int{}
+	timers := map[string]*time.Timer{}
+	settled := make(chan settledFile)
+	results := make(chan Result)
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Write) {
+				continue
+			}
+			if !opts.inputExts.matches(event.Name) {
+				continue
+			}
+
+			if timer, ok := timers[event.Name]; ok {
+				timer.Stop()
+			}
+			generations[event.Name]++
+			file := settledFile{event.Name, generations[event.Name]}
+			timers[event.Name] = time.AfterFunc(delay, func() { settled <- file })
+		case file := <-settled:
+			if generations[file.path] != file.generation {
+				continue
+			}
+			delete(generations, file.path)
+			delete(timers, file.path)
+
+			go run(ctx, job{file: file.path}, opts, results)
+		case result := <-results:
+			emit(&result)
+		case <-ctx.Done():
+			return nil
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"archive/zip"
+	"compress/bzip2"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// methodBzip2 is the bzip2 compression method from the zip APPNOTE. Go has a
+// bzip2 decompressor, so such entries are readable once it is registered.
+// The other methods some archivers use (deflate64, lzma, zstd, xz, ppmd) have
+// no decompressor in the standard library and are reported by name instead.
+const methodBzip2 = 12
+
+func init() {
+	zip.RegisterDecompressor(methodBzip2, func(r io.Reader) io.ReadCloser {
+		return io.NopCloser(bzip2.NewReader(r))
+	})
+}
+
+// zipMethods names the compression methods openEntry may have to report.
+var zipMethods = map[uint16]string{
+	zip.Store:   "store",
+	zip.Deflate: "deflate",
+	9:           "deflate64",
+	methodBzip2: "bzip2",
+	14:          "lzma",
+	93:          "zstd",
+	95:          "xz",
+	98:          "ppmd",
+	99:          "AES encryption",
+}
+
+// supportedMethods lists the compression methods that can be read.
+const supportedMethods = "store, deflate and bzip2"
+
+// openEntry opens a zip entry, explaining which compression method is at
+// fault when archive/zip can't decompress it.
+func openEntry(file *zip.File) (io.ReadCloser, error) {
+	rc, err := file.Open()
+	if !errors.Is(err, zip.ErrAlgorithm) {
+		return rc, err
+	}
+
+	method := fmt.Sprintf("method %d", file.Method)
+	if name, ok := zipMethods[file.Method]; ok {
+		method = fmt.Sprintf("%s (method %d)", name, file.Method)
+	}
+
+	return nil, fmt.Errorf("%s is compressed with %s, which isn't supported; the supported methods are %s", file.Name, method, supportedMethods)
+}
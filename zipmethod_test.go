@@ -0,0 +1,71 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testdata/zip/bzip2.epub has its OPF and chapter compressed with bzip2
+// (method 12), as some archivers write them.
+func TestReadBzip2Epub(t *testing.T) {
+	path := filepath.Join("testdata", "zip", "bzip2.epub")
+
+	data, ext, err := readBook(path, path, &options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Title != "The Time Machine" || data.Author != "H. G. Wells" || ext != ".epub" {
+		t.Errorf("got %q by %q (%s), want The Time Machine by H. G. Wells", data.Title, data.Author, ext)
+	}
+}
+
+// Entries compressed with a method there is no decompressor for name it,
+// by name and ID, along with the methods that are supported.
+func TestUnsupportedMethod(t *testing.T) {
+	var b bytes.Buffer
+	w := zip.NewWriter(&b)
+	// write deflate64 (method 9) entries as they are, which is enough for
+	// the reader to reject them
+	w.RegisterCompressor(9, func(out io.Writer) (io.WriteCloser, error) {
+		return nopWriteCloser{out}, nil
+	})
+	for _, entry := range epubEntries("content.opf", testOPF("Dune", "Frank Herbert", "")) {
+		if entry.name == "content.opf" {
+			entry.method = 9
+		}
+		f, err := w.CreateHeader(&zip.FileHeader{Name: entry.name, Method: entry.method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = f.Write([]byte(entry.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "deflate64.epub")
+	if err := os.WriteFile(path, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "content.opf is compressed with deflate64 (method 9), which isn't supported; the supported methods are store, deflate and bzip2"
+	for _, native := range []bool{false, true} {
+		_, _, err := readBook(path, path, &options{nativeDetect: native})
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("native detection %v: got %v, want an error containing %q", native, err, want)
+		}
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }